@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	AggregationNone = "none"
+	AggregationLast = "last"
+	AggregationAvg  = "avg"
+	AggregationMax  = "max"
+)
+
+// aggregate collapses the samples of each series in tss into a single sample
+// timestamped with the latest of them, valued according to mode. tss is
+// returned unchanged for AggregationNone. A series whose latest sample is a
+// staleness marker is reduced to the marker.
+func aggregate(tss []prompb.TimeSeries, mode string) []prompb.TimeSeries {
+	if mode == AggregationNone || mode == "" {
+		return tss
+	}
+	out := mergeSeries(tss)
+	for i, ts := range out {
+		var sum float64
+		var n int
+
+		last := ts.Samples[len(ts.Samples)-1]
+		if value.IsStaleNaN(last.Value) || mode == AggregationLast {
+			out[i].Samples = []prompb.Sample{last}
+			continue
+		}
+		highest := last.Value
+		for _, s := range ts.Samples {
+			if value.IsStaleNaN(s.Value) {
+				continue
+			}
+			sum += s.Value
+			n++
+			if s.Value > highest {
+				highest = s.Value
+			}
+		}
+		switch mode {
+		case AggregationAvg:
+			last.Value = sum / float64(n)
+		case AggregationMax:
+			last.Value = highest
+		}
+		out[i].Samples = []prompb.Sample{last}
+	}
+	return out
+}
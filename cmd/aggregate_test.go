@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"reflect"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	tss := interleaved()
+	for _, tc := range []struct {
+		mode string
+		// want are the values of the fridge and kettle current_power series
+		want []float64
+	}{
+		{mode: AggregationLast, want: []float64{60, 40}},
+		{mode: AggregationAvg, want: []float64{40, 30}},
+		{mode: AggregationMax, want: []float64{60, 40}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			want := []prompb.TimeSeries{
+				{Labels: tss[0].Labels, Samples: []prompb.Sample{{Value: tc.want[0], Timestamp: 3000}}},
+				{Labels: tss[1].Labels, Samples: []prompb.Sample{{Value: tc.want[1], Timestamp: 2500}}},
+				{Labels: tss[6].Labels, Samples: []prompb.Sample{{Value: 1, Timestamp: 2500}}},
+			}
+			if got := aggregate(interleaved(), tc.mode); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type (
+	// diskBuffer persists time-series that have not yet been pushed to a file
+	// so that they survive restarts. A nil *diskBuffer disables buffering.
+	diskBuffer struct {
+		path      string
+		retention time.Duration
+	}
+)
+
+func newDiskBuffer(path string, retention int) *diskBuffer {
+	if path == "" {
+		return nil
+	}
+	return &diskBuffer{path: path, retention: time.Duration(retention) * time.Second}
+}
+
+// save replaces the buffer contents with tss, removing the file when tss is
+// empty.
+func (b *diskBuffer) save(tss []prompb.TimeSeries) {
+	var data []byte
+	var err error
+
+	if b == nil {
+		return
+	}
+	if len(tss) == 0 {
+		if err = os.Remove(b.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Warningf("could not remove buffer %s: %s", b.path, err)
+		}
+		return
+	}
+	if data, err = proto.Marshal(&prompb.WriteRequest{Timeseries: tss}); err != nil {
+		log.Warningf("could not marshal buffer: %s", err)
+		return
+	}
+	// write to a temporary file and rename so a crash cannot leave a partial
+	// buffer behind
+	tmp := filepath.Join(filepath.Dir(b.path), "."+filepath.Base(b.path)+".tmp")
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		log.Warningf("could not write buffer %s: %s", tmp, err)
+		return
+	}
+	if err = os.Rename(tmp, b.path); err != nil {
+		log.Warningf("could not write buffer %s: %s", b.path, err)
+	}
+}
+
+// load returns the time-series persisted by a previous run, which may
+// include samples older than the retention period.
+func (b *diskBuffer) load() []prompb.TimeSeries {
+	var data []byte
+	var err error
+	var req prompb.WriteRequest
+
+	if b == nil {
+		return nil
+	}
+	if data, err = os.ReadFile(b.path); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warningf("could not read buffer %s: %s", b.path, err)
+		}
+		return nil
+	}
+	if err = proto.Unmarshal(data, &req); err != nil {
+		log.Warningf("could not unmarshal buffer %s, discarding: %s", b.path, err)
+		return nil
+	}
+	return req.Timeseries
+}
+
+// expire drops samples older than the retention period at now from tss,
+// along with any time-series left without samples, returning the number of
+// samples dropped.
+func (b *diskBuffer) expire(tss []prompb.TimeSeries, now time.Time) ([]prompb.TimeSeries, int) {
+	if b == nil || b.retention <= 0 {
+		return tss, 0
+	}
+	kept, n := expireSamples(tss, now.Add(-b.retention).UnixMilli())
+	if expired := len(tss) - len(kept); expired > 0 {
+		log.Infof("discarded %d buffered timeseries older than %s", expired, b.retention)
+	}
+	return kept, n
+}
+
+// expireSamples returns the samples of tss timestamped from cutoff onwards,
+// omitting time-series left without samples, and the number of samples
+// dropped. tss is left unchanged.
+func expireSamples(tss []prompb.TimeSeries, cutoff int64) ([]prompb.TimeSeries, int) {
+	var n int
+	var kept []prompb.TimeSeries
+	for _, ts := range tss {
+		var samples []prompb.Sample
+		for _, s := range ts.Samples {
+			if s.Timestamp >= cutoff {
+				samples = append(samples, s)
+			}
+		}
+		n += len(ts.Samples) - len(samples)
+		if len(samples) > 0 {
+			ts.Samples = samples
+			kept = append(kept, ts)
+		}
+	}
+	return kept, n
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"time"
+)
+
+type (
+	// clock provides the current time, tickers and sleeps, allowing timing
+	// to be controlled when the collectors and WriteMetrics are driven by a
+	// fake.
+	clock interface {
+		Now() time.Time
+		NewTicker(d time.Duration) ticker
+		Sleep(d time.Duration)
+	}
+	// ticker is the subset of *time.Ticker used by tapmon.
+	ticker interface {
+		C() <-chan time.Time
+		Reset(d time.Duration)
+		Stop()
+	}
+	// realClock is the clock backed by the time package.
+	realClock  struct{}
+	realTicker struct {
+		t *time.Ticker
+	}
+)
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{t: time.NewTicker(d)}
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (r realTicker) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTicker) Reset(d time.Duration) {
+	r.t.Reset(d)
+}
+
+func (r realTicker) Stop() {
+	r.t.Stop()
+}
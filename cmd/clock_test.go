@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	// fakeClock is a clock whose time only moves when advanced, or slept on,
+	// firing the tickers that fall due.
+	fakeClock struct {
+		mu      sync.Mutex
+		now     time.Time
+		tickers []*fakeTicker
+		// slept holds the duration of each Sleep
+		slept []time.Duration
+	}
+	fakeTicker struct {
+		clk     *fakeClock
+		c       chan time.Time
+		period  time.Duration
+		next    time.Time
+		stopped bool
+	}
+)
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clk: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Sleep advances the clock by d rather than blocking.
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	c.slept = append(c.slept, d)
+	c.mu.Unlock()
+	c.Advance(d)
+}
+
+// Advance moves the clock on by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(c.now.Add(d))
+}
+
+// set moves the clock to now, sending a tick on each ticker due by then. It
+// is called with mu held.
+func (c *fakeClock) set(now time.Time) {
+	c.now = now
+	for _, t := range c.tickers {
+		if t.stopped || t.next.After(now) {
+			continue
+		}
+		select {
+		case t.c <- now:
+		default:
+		}
+		t.next = now.Add(t.period)
+	}
+}
+
+// nextTick returns when the earliest running ticker is next due, or the zero
+// time when none are running.
+func (c *fakeClock) nextTick() time.Time {
+	var next time.Time
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range c.tickers {
+		if !t.stopped && (next.IsZero() || t.next.Before(next)) {
+			next = t.next
+		}
+	}
+	return next
+}
+
+// sleeps returns the durations slept so far.
+func (c *fakeClock) sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.slept...)
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	t.clk.mu.Lock()
+	defer t.clk.mu.Unlock()
+	t.period, t.next, t.stopped = d, t.clk.now.Add(d), false
+}
+
+func (t *fakeTicker) Stop() {
+	t.clk.mu.Lock()
+	defer t.clk.mu.Unlock()
+	t.stopped = true
+}
+
+// waitFor fails t unless cond becomes true within a few seconds, for
+// conditions met by other goroutines.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestFakeTicker(t *testing.T) {
+	clk := newFakeClock(time.Unix(0, 0))
+	tk := clk.NewTicker(10 * time.Second)
+
+	clk.Advance(9 * time.Second)
+	select {
+	case <-tk.C():
+		t.Fatal("ticked before its period")
+	default:
+	}
+	clk.Advance(time.Second)
+	select {
+	case now := <-tk.C():
+		if want := time.Unix(10, 0); !now.Equal(want) {
+			t.Errorf("got tick at %s, want %s", now, want)
+		}
+	default:
+		t.Fatal("did not tick after its period")
+	}
+	tk.Stop()
+	clk.Advance(time.Minute)
+	select {
+	case <-tk.C():
+		t.Fatal("ticked after being stopped")
+	default:
+	}
+}
@@ -0,0 +1,770 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/richardjennings/tapo/pkg/tapo"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// reconnectAfter is the number of consecutive collection failures after
+	// which the device session is re-created.
+	reconnectAfter = 3
+	// reconnectBackoffMax caps the exponential backoff between reconnect
+	// attempts.
+	reconnectBackoffMax = 30 * time.Minute
+	// failureLogInterval is how often repeated collection failures of a
+	// device are summarised in the log after the first is logged.
+	failureLogInterval = 5 * time.Minute
+)
+
+// authErrorCodes are the device error codes returned when the session has
+// expired or the credentials were rejected.
+var authErrorCodes = map[int]bool{
+	9999:  true, // session timeout
+	-1501: true, // invalid credentials
+}
+
+// errAuth is wrapped by errors returned for device responses with one of
+// authErrorCodes.
+var errAuth = errors.New("device session expired or credentials rejected")
+
+// droppedSamples counts time-series dropped because the metrics queue was
+// full.
+var droppedSamples atomic.Uint64
+
+// metricNamespace is prefixed to the name of every collected time-series,
+// set from Prometheus.Namespace at startup.
+var metricNamespace string
+
+var (
+	// enabledMetrics selects the collected metrics, set from Config.Metrics
+	// on start and reload.
+	enabledMetrics atomic.Pointer[MetricToggles]
+	// requestTimeout bounds each device request unless the device overrides
+	// it, set from Config.RequestTimeout on start and reload.
+	requestTimeout atomic.Int64
+	// newPlug logs in to the device at ip, replaced in tests by a fake plug.
+	newPlug = func(ip, username, password string) (plug, error) {
+		return tapo.NewTapo(ip, username, password)
+	}
+)
+
+func init() {
+	setCollection(Config{
+		RequestTimeout: 10,
+		Metrics: MetricToggles{
+			Power: true, Voltage: true, Current: true, Energy: true,
+			State: true, Wifi: true, Overheated: true, PowerProtection: true, Uptime: true, Info: true,
+		},
+	})
+}
+
+// setCollection sets the enabled metrics and request timeout read by each
+// poll from conf.
+func setCollection(conf Config) {
+	m := conf.Metrics
+	enabledMetrics.Store(&m)
+	requestTimeout.Store(int64(time.Duration(conf.RequestTimeout) * time.Second))
+}
+
+type (
+	// EnergyReader reads the energy usage of a device.
+	EnergyReader interface {
+		GetEnergyUsage() (map[string]interface{}, error)
+	}
+	// plug is the subset of *tapo.Tapo used to monitor and control a device,
+	// allowing it to be replaced with a fake.
+	plug interface {
+		EnergyReader
+		DeviceInfo() (map[string]interface{}, error)
+		TurnOn() (map[string]interface{}, error)
+		TurnOff() (map[string]interface{}, error)
+	}
+	client struct {
+		t plug
+		d Device
+	}
+	// poller is the collection state of a device between scheduled polls.
+	// It is only used by one worker at a time.
+	poller struct {
+		c             client
+		opts          collectOptions
+		failures      int
+		missed        int
+		backoff       time.Duration
+		nextReconnect time.Time
+		// open is set while the circuit breaker is open
+		open bool
+		// failing is set once a failure has been logged, until the next
+		// successful poll, with unlogged counting the failures since
+		// loggedAt
+		failing  bool
+		unlogged int
+		loggedAt time.Time
+		// last holds the time-series of the last successful poll, used to
+		// mark them stale
+		last []prompb.TimeSeries
+		// offset is the offset of each poll within the interval when
+		// spreading polls
+		offset time.Duration
+		// errorsTotal counts failed polls for collection_errors_total,
+		// surviving reconnects
+		errorsTotal float64
+	}
+	// queues holds a channel of time-series for each WriteMetrics.
+	queues []chan prompb.TimeSeries
+)
+
+// deviceLog returns a logger for lines about the device with ip, letting
+// them be filtered on the device_ip field.
+func deviceLog(ip string) *log.Entry {
+	return log.WithField("device_ip", ip)
+}
+
+// connect establishes a session with the device d.
+func connect(d Device) (c client, err error) {
+	// tapo.NewTapo panics rather than erroring on some failures such as the
+	// device being unreachable
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	t, err := newPlug(d.Ip, d.Username, d.Password)
+	if err != nil {
+		return c, err
+	}
+	deviceLog(d.Ip).Infof("connected to device %s", d.Ip)
+	return client{t: t, d: d}, nil
+}
+
+// connectAll connects to devices concurrently, at most concurrency at a time,
+// returning a client for each device connected to within timeout in the
+// order of devices. Each device is retried up to retries times, delay apart
+// doubling after each attempt. Devices that could not be connected to are
+// logged.
+func connectAll(devices []Device, concurrency int, timeout time.Duration, retries int, delay time.Duration) []client {
+	var g errgroup.Group
+	var clients []client
+
+	connected := make([]*client, len(devices))
+	g.SetLimit(concurrency)
+	for i, d := range devices {
+		i, d := i, d
+		g.Go(func() error {
+			c, err := connectRetrying(d, timeout, retries, delay)
+			if err != nil {
+				deviceLog(d.Ip).Warningf("could not connect to Device with ip %s, skipping: %s", d.Ip, err)
+				return nil
+			}
+			connected[i] = &c
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	for _, c := range connected {
+		if c != nil {
+			clients = append(clients, *c)
+		}
+	}
+	log.Infof("connected to %d of %d devices", len(clients), len(devices))
+	return clients
+}
+
+// connectRetrying connects to d within timeout, retrying up to retries times
+// with a delay doubling after each attempt.
+func connectRetrying(d Device, timeout time.Duration, retries int, delay time.Duration) (client, error) {
+	for attempt := 1; ; attempt++ {
+		c, err := connectWithin(d, timeout)
+		if err == nil {
+			if attempt > 1 {
+				deviceLog(d.Ip).Infof("connected to device %s on attempt %d", d.Ip, attempt)
+			}
+			return c, nil
+		}
+		if attempt > retries {
+			return c, fmt.Errorf("%d attempts failed, last error: %w", attempt, err)
+		}
+		deviceLog(d.Ip).Infof("could not connect to device %s, attempt %d of %d, retrying in %s: %s", d.Ip, attempt, retries+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// connectWithin connects to d, giving up after timeout. The tapo client
+// cannot be cancelled so a timed out connection attempt is left to finish in
+// the background.
+func connectWithin(d Device, timeout time.Duration) (client, error) {
+	type result struct {
+		c   client
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := connect(d)
+		done <- result{c, err}
+	}()
+	select {
+	case r := <-done:
+		return r.c, r.err
+	case <-time.After(timeout):
+		return client{}, fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// poll makes a single scheduled collection from the device, sending the
+// resulting time-series to metrics for remote write and updating gauges for
+// pull mode. Either of metrics or gauges may be nil when that mode is not in
+// use. A device started without a session is connected to first, within the
+// connect timeout. After reconnectAfter consecutive failures the device is
+// reconnected, backing off exponentially between unsuccessful attempts. An
+// expired session is logged in to again straight away rather than counting as
+// a failure. After staleAfter polls without a reading the device's gauges are
+// removed and its time-series marked stale. After breakerAfter consecutive
+// failures the circuit breaker opens and the device is only probed every
+// probeInterval until it responds.
+func (p *poller) poll(clk clock, metrics queues, gauges *gaugeSet) {
+	var err error
+	var tss []prompb.TimeSeries
+	var nc client
+
+	c := p.c
+	switch {
+	case p.open:
+		// each probe reconnects as the session has likely expired
+		if nc, err = connectWithin(c.d, c.d.effectiveRequestTimeout()); err == nil {
+			p.c, c = nc, nc
+			tss, err = collect(c, p.timestamp(clk.Now()))
+		}
+		collectionsTotal.WithLabelValues(c.d.Ip, result(err)).Inc()
+		if err != nil {
+			p.failures++
+			p.countError(clk.Now(), metrics, gauges)
+			deviceLog(c.d.Ip).Debugf("probe of device %s failed: %s", c.d.Ip, err)
+			return
+		}
+		deviceLog(c.d.Ip).Infof("device %s is responding again after %d failures, closing circuit breaker", c.d.Ip, p.failures)
+		p.open, p.failing = false, false
+		circuitOpen.WithLabelValues(c.d.Ip).Set(0)
+		p.backoff = p.period()
+		p.record(append(tss, p.pollSeries(clk.Now())...), metrics, gauges)
+		return
+	case c.t == nil, p.failures >= reconnectAfter:
+		if clk.Now().Before(p.nextReconnect) {
+			// a poll skipped while backing off still fails, so that up is
+			// sent every interval
+			collectionsTotal.WithLabelValues(c.d.Ip, "failure").Inc()
+			p.countError(clk.Now(), metrics, gauges)
+			return
+		}
+		timeout := c.d.effectiveRequestTimeout()
+		if c.t == nil {
+			deviceLog(c.d.Ip).Infof("connecting to device %s", c.d.Ip)
+			timeout = p.opts.connectTimeout
+		} else {
+			deviceLog(c.d.Ip).Infof("reconnecting to device %s after %d consecutive failures", c.d.Ip, p.failures)
+		}
+		if nc, err = connectWithin(c.d, timeout); err != nil {
+			p.failures++
+			p.countError(clk.Now(), metrics, gauges)
+			if p.trip() {
+				return
+			}
+			p.nextReconnect = clk.Now().Add(p.backoff)
+			deviceLog(c.d.Ip).Warningf("could not reconnect to device %s, retrying in %s: %s", c.d.Ip, p.backoff, err)
+			if p.backoff *= 2; p.backoff > reconnectBackoffMax {
+				p.backoff = reconnectBackoffMax
+			}
+			return
+		}
+		deviceLog(c.d.Ip).Infof("reconnected to device %s", c.d.Ip)
+		p.c, c = nc, nc
+		p.failures = 0
+		p.backoff = p.period()
+	}
+
+	tss, err = collect(c, p.timestamp(clk.Now()))
+	if errors.Is(err, errAuth) {
+		deviceLog(c.d.Ip).Infof("logging in to device %s again: %s", c.d.Ip, err)
+		if nc, err = connectWithin(c.d, c.d.effectiveRequestTimeout()); err != nil {
+			err = fmt.Errorf("could not log in again: %w", err)
+		} else {
+			p.c, c = nc, nc
+			tss, err = collect(c, p.timestamp(clk.Now()))
+		}
+	}
+	collectionsTotal.WithLabelValues(c.d.Ip, result(err)).Inc()
+	if err != nil {
+		p.failures++
+		p.countError(clk.Now(), metrics, gauges)
+		if !p.trip() {
+			p.logFailure(clk.Now(), err)
+		}
+		return
+	}
+	p.record(append(tss, p.pollSeries(clk.Now())...), metrics, gauges)
+}
+
+// countError counts a failed poll, sending collection_errors_total and up
+// of 0 at once as a failed poll has no other time-series to send them with.
+// The device is marked stale once staleAfter consecutive polls have failed.
+func (p *poller) countError(now time.Time, metrics queues, gauges *gaugeSet) {
+	p.errorsTotal++
+	// reset on a successful reading
+	p.missed++
+	if p.missed == p.opts.staleAfter && p.last != nil {
+		deviceLog(p.c.d.Ip).Warningf("no reading from device %s for %d polls, marking it stale", p.c.d.Ip, p.missed)
+		if gauges != nil {
+			gauges.delete(p.c.d.Ip)
+		}
+		if p.opts.staleMarkers {
+			for _, ts := range staleMarkers(p.last, now) {
+				metrics.enqueue(ts)
+			}
+		}
+		p.last = nil
+	}
+	for _, ts := range []prompb.TimeSeries{p.errorSeries(now), p.c.timeSeries(upMetric, 0, p.timestamp(now).UnixMilli())} {
+		metrics.enqueue(ts)
+		if gauges != nil {
+			gauges.set(ts)
+		}
+	}
+}
+
+// pollSeries returns the time-series describing the polling of the device
+// sent with each reading, collection_errors_total, poll_interval_seconds,
+// the interval after any device override, and up of 1.
+func (p *poller) pollSeries(now time.Time) []prompb.TimeSeries {
+	return []prompb.TimeSeries{
+		p.errorSeries(now),
+		p.c.timeSeries(pollIntervalMetric, float64(p.opts.interval), p.timestamp(now).UnixMilli()),
+		p.c.timeSeries(upMetric, 1, p.timestamp(now).UnixMilli()),
+	}
+}
+
+// errorSeries returns collection_errors_total for the device at now.
+func (p *poller) errorSeries(now time.Time) prompb.TimeSeries {
+	return p.c.timeSeries(collectionErrorsMetric, p.errorsTotal, p.timestamp(now).UnixMilli())
+}
+
+// trip opens the circuit breaker once failures reaches breakerAfter,
+// reporting whether it is open.
+func (p *poller) trip() bool {
+	if p.opts.breakerAfter == 0 || p.failures < p.opts.breakerAfter {
+		return false
+	}
+	p.open = true
+	circuitOpen.WithLabelValues(p.c.d.Ip).Set(1)
+	deviceLog(p.c.d.Ip).Warningf("device %s failed %d times in a row, opening circuit breaker and probing every %s", p.c.d.Ip, p.failures, p.period())
+	return true
+}
+
+// logFailure logs the first of consecutive collection failures straight
+// away, then a summary of further failures at most every failureLogInterval.
+func (p *poller) logFailure(now time.Time, err error) {
+	ip := p.c.d.Ip
+	if !p.failing {
+		deviceLog(ip).Warningf("could not collect energy usage for %s: %s", ip, err)
+		p.failing, p.unlogged, p.loggedAt = true, 0, now
+		return
+	}
+	p.unlogged++
+	if since := now.Sub(p.loggedAt); since >= failureLogInterval {
+		deviceLog(ip).Warningf("could not collect energy usage for %s, failed %d times in the last %s: %s", ip, p.unlogged, since.Round(time.Second), err)
+		p.unlogged, p.loggedAt = 0, now
+		return
+	}
+	deviceLog(ip).Debugf("could not collect energy usage for %s: %s", ip, err)
+}
+
+// record handles the time-series of a successful poll.
+func (p *poller) record(tss []prompb.TimeSeries, metrics queues, gauges *gaugeSet) {
+	if p.failing {
+		deviceLog(p.c.d.Ip).Infof("collecting from device %s again", p.c.d.Ip)
+		p.failing = false
+	}
+	p.failures = 0
+	p.missed = 0
+	p.last = tss
+	readiness.collected.Store(true)
+	for _, ts := range tss {
+		if gauges != nil {
+			gauges.set(ts)
+		}
+		metrics.enqueue(ts)
+	}
+}
+
+// apply replaces the device and options of p with those of s.
+func (p *poller) apply(s settings) {
+	p.c.d, p.opts, p.offset = s.d, s.opts, s.offset
+}
+
+// next returns when p is next due after a poll at now, jittered or at its
+// offset when spreading polls.
+func (p *poller) next(now time.Time) time.Time {
+	if p.opts.spread {
+		return nextSlot(now, p.period(), p.offset)
+	}
+	return now.Add(jittered(p.period(), p.opts.jitter))
+}
+
+// period returns the poll interval of p, or the probe interval while its
+// circuit breaker is open.
+func (p *poller) period() time.Duration {
+	if p.open {
+		return time.Duration(p.opts.probeInterval) * time.Second
+	}
+	return time.Duration(p.opts.interval) * time.Second
+}
+
+// timestamp returns the time the samples of a poll at now are stamped with,
+// truncated to the poll interval when aligning timestamps so that the devices
+// polled in the same interval share a timestamp.
+func (p *poller) timestamp(now time.Time) time.Time {
+	if !p.opts.alignTimestamps {
+		return now
+	}
+	return now.Truncate(time.Duration(p.opts.interval) * time.Second)
+}
+
+// staleMarkers returns a staleness marker timestamped t for each of tss,
+// telling Prometheus the time-series have ended.
+func staleMarkers(tss []prompb.TimeSeries, t time.Time) []prompb.TimeSeries {
+	out := make([]prompb.TimeSeries, len(tss))
+	for i, ts := range tss {
+		out[i] = prompb.TimeSeries{
+			Labels:  ts.Labels,
+			Samples: []prompb.Sample{{Timestamp: t.UnixMilli(), Value: math.Float64frombits(value.StaleNaN)}},
+		}
+	}
+	return out
+}
+
+// jittered returns d randomly adjusted by up to fraction of d either way.
+func jittered(d time.Duration, fraction float64) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+}
+
+// collectOnce collects from each of cs a single time, queueing the resulting
+// time-series on metrics. An error is returned if any device failed.
+func collectOnce(clk clock, cs []client, metrics queues) error {
+	var tss []prompb.TimeSeries
+	var err error
+	var failed int
+
+	for _, c := range cs {
+		if tss, err = collect(c, clk.Now()); err != nil {
+			deviceLog(c.d.Ip).Warningf("could not collect energy usage for %s: %s", c.d.Ip, err)
+			failed++
+			continue
+		}
+		for _, ts := range tss {
+			metrics.enqueue(ts)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not collect energy usage from %d devices", failed)
+	}
+	return nil
+}
+
+// enqueue sends ts to each of qs.
+func (qs queues) enqueue(ts prompb.TimeSeries) {
+	for _, q := range qs {
+		enqueue(q, ts)
+	}
+}
+
+// enqueue sends ts to metrics without blocking, dropping the oldest queued
+// time-series when metrics is full so that a stalled WriteMetrics does not
+// hold up collection.
+func enqueue(metrics chan prompb.TimeSeries, ts prompb.TimeSeries) {
+	for {
+		select {
+		case metrics <- ts:
+			return
+		default:
+		}
+		select {
+		case <-metrics:
+			droppedSamples.Add(1)
+			droppedTotal.Inc()
+		default:
+		}
+	}
+}
+
+// collect reads the energy usage and device info of the device c, returning a
+// time-series timestamped t for each metric it reports. Failing to read the
+// device info is logged rather than failing the collection.
+func collect(c client, t time.Time) (tss []prompb.TimeSeries, err error) {
+	var info []prompb.TimeSeries
+
+	now := t.UnixMilli()
+	m := enabledMetrics.Load()
+	if m.energyUsage() {
+		if tss, err = collectEnergyUsage(c, now); err != nil {
+			return nil, err
+		}
+	}
+	if !m.deviceInfo() {
+		return tss, nil
+	}
+	if info, err = collectDeviceInfo(c, now); err != nil {
+		// without energy usage the device info is the collection
+		if !m.energyUsage() {
+			return nil, err
+		}
+		deviceLog(c.d.Ip).Warningf("could not get device info for %s: %s", c.d.Ip, err)
+		return tss, nil
+	}
+	return append(tss, info...), nil
+}
+
+// collectEnergyUsage returns time-series for the enabled energy usage metrics
+// reported by c. When the result has a list of channels, as multi-channel
+// meters report, each channel's metrics are labelled with its position.
+func collectEnergyUsage(c client, now int64) (tss []prompb.TimeSeries, err error) {
+	var r map[string]interface{}
+	var result map[string]interface{}
+	var ok bool
+	var ts []prompb.TimeSeries
+
+	if r, err = c.call(c.t.GetEnergyUsage); err != nil {
+		return nil, err
+	}
+	if err = responseError(r); err != nil {
+		return nil, fmt.Errorf("energy usage request failed: %w", err)
+	}
+	if result, ok = r["result"].(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("energy usage response has no result: %v", r)
+	}
+	channels, _ := result["channels"].([]interface{})
+	if len(channels) == 0 {
+		return energyUsageSeries(c, result, now)
+	}
+	for i, ch := range channels {
+		if result, ok = ch.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("energy usage response has an invalid channel %d: %v", i, r)
+		}
+		if ts, err = energyUsageSeries(c, result, now, prompb.Label{Name: "channel", Value: strconv.Itoa(i)}); err != nil {
+			return nil, fmt.Errorf("channel %d: %w", i, err)
+		}
+		tss = append(tss, ts...)
+	}
+	return tss, nil
+}
+
+// energyUsageSeries returns time-series for the enabled energy usage metrics
+// in result, the result of an energy usage response or one of its channels,
+// labelled with extra.
+func energyUsageSeries(c client, result map[string]interface{}, now int64, extra ...prompb.Label) (tss []prompb.TimeSeries, err error) {
+	var ok bool
+	var v float64
+
+	m := enabledMetrics.Load()
+	if m.Power {
+		if v, ok = result["current_power"].(float64); !ok {
+			return nil, fmt.Errorf("energy usage response has no current_power: %v", result)
+		}
+		tss = append(tss, c.timeSeries(currentPowerMetric, v, now, extra...))
+	}
+	// voltage and current are not reported by every model
+	if v, ok = result["voltage_mv"].(float64); ok && m.Voltage {
+		tss = append(tss, c.timeSeries(voltageMetric, v/1000, now, extra...))
+	}
+	if v, ok = result["current_ma"].(float64); ok && m.Current {
+		tss = append(tss, c.timeSeries(currentMetric, v/1000, now, extra...))
+	}
+	if !m.Energy {
+		return tss, nil
+	}
+	// today_energy resets at midnight, which Prometheus treats as a counter
+	// reset so increase() and rate() remain correct
+	if v, ok = result["today_energy"].(float64); ok {
+		tss = append(tss, c.timeSeries(energyMetric, v, now, extra...))
+		tss = append(tss, c.timeSeries(todayEnergyMetric, v, now, extra...))
+	}
+	// the daily and monthly totals shown in the Tapo app are part of the
+	// energy usage response, so they need no separate request
+	if v, ok = result["month_energy"].(float64); ok {
+		tss = append(tss, c.timeSeries(monthEnergyMetric, v, now, extra...))
+	}
+	return tss, nil
+}
+
+// responseError returns an error describing the non-zero error_code of the
+// device response r, or nil if r reports success. Error responses carry no
+// usable result.
+func responseError(r map[string]interface{}) error {
+	code, ok := r["error_code"].(float64)
+	if !ok || code == 0 {
+		return nil
+	}
+	if authErrorCodes[int(code)] {
+		return fmt.Errorf("%w: error code %d", errAuth, int(code))
+	}
+	if msg, ok := r["msg"].(string); ok && msg != "" {
+		return fmt.Errorf("device returned error code %d: %s", int(code), msg)
+	}
+	return fmt.Errorf("device returned error code %d", int(code))
+}
+
+// collectDeviceInfo returns time-series for the enabled device info metrics
+// reported by c, skipping any the model does not report.
+func collectDeviceInfo(c client, now int64) (tss []prompb.TimeSeries, err error) {
+	var r map[string]interface{}
+	var result map[string]interface{}
+	var ok bool
+	var on bool
+	var v float64
+	var status string
+
+	if r, err = c.call(c.t.DeviceInfo); err != nil {
+		return nil, err
+	}
+	if err = responseError(r); err != nil {
+		return nil, fmt.Errorf("device info request failed: %w", err)
+	}
+	if result, ok = r["result"].(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("device info response has no result: %v", r)
+	}
+	m := enabledMetrics.Load()
+	if on, ok = result["device_on"].(bool); ok && m.State {
+		tss = append(tss, c.timeSeries(deviceOnMetric, boolValue(on), now))
+	}
+	// signal strength is reported as rssi, signal_level or both depending on
+	// the model
+	if v, ok = result["rssi"].(float64); ok && m.Wifi {
+		tss = append(tss, c.timeSeries(wifiRSSIMetric, v, now))
+	}
+	if v, ok = result["signal_level"].(float64); ok && m.Wifi {
+		tss = append(tss, c.timeSeries(wifiSignalLevelMetric, v, now))
+	}
+	// older firmware reports overheated as a bool, newer firmware as an
+	// overheat_status of "normal" or otherwise
+	if on, ok = result["overheated"].(bool); ok && m.Overheated {
+		tss = append(tss, c.timeSeries(overheatedMetric, boolValue(on), now))
+	} else if status, ok = result["overheat_status"].(string); ok && m.Overheated {
+		tss = append(tss, c.timeSeries(overheatedMetric, boolValue(status != "normal"), now))
+	}
+	if status, ok = result["power_protection_status"].(string); ok && m.PowerProtection {
+		tss = append(tss, c.timeSeries(powerProtectionMetric, boolValue(status != "normal"), now))
+	}
+	// the nickname set in the Tapo app is base64 encoded
+	if status, ok = result["nickname"].(string); ok && m.Info {
+		if b, err := base64.StdEncoding.DecodeString(status); err == nil {
+			status = string(b)
+		}
+		if status = strings.TrimSpace(status); status != "" {
+			tss = append(tss, c.timeSeries(deviceInfoMetric, 1, now, prompb.Label{Name: "nickname", Value: status}))
+		}
+	}
+	// uptime is reported as on_time by most firmware and uptime by some
+	for _, key := range []string{"on_time", "uptime"} {
+		if v, ok = result[key].(float64); ok && m.Uptime {
+			tss = append(tss, c.timeSeries(uptimeMetric, v, now))
+			break
+		}
+	}
+	return tss, nil
+}
+
+// boolValue returns 1 for true and 0 for false.
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// request calls fn, converting the panics tapo.Tapo raises on some malformed
+// responses into errors.
+func request(fn func() (map[string]interface{}, error)) (r map[string]interface{}, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%v", rec)
+		}
+	}()
+	return fn()
+}
+
+// call makes the request fn to the device within the request timeout. The
+// tapo client cannot be cancelled so a timed out request is left to finish in
+// the background.
+func (c client) call(fn func() (map[string]interface{}, error)) (map[string]interface{}, error) {
+	type result struct {
+		r   map[string]interface{}
+		err error
+	}
+	timeout := c.d.effectiveRequestTimeout()
+	done := make(chan result, 1)
+	go func() {
+		r, err := request(fn)
+		done <- result{r, err}
+	}()
+	select {
+	case res := <-done:
+		return res.r, res.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("request timed out after %s", timeout)
+	}
+}
+
+// timeSeries returns a single sample time-series for metric m labelled with
+// the device ip, the device name when configured and extra.
+func (c client) timeSeries(m metricDesc, v float64, t int64, extra ...prompb.Label) prompb.TimeSeries {
+	labels := append([]prompb.Label{{Name: "ip", Value: c.d.Ip}, {Name: "name", Value: c.d.Name}}, extra...)
+	return prompb.TimeSeries{
+		Labels: seriesLabels(m.fullName(), labels...),
+		Samples: []prompb.Sample{{
+			Timestamp: t,
+			Value:     v,
+		}},
+	}
+}
+
+// seriesLabels returns the labels of a time-series of metric name with
+// labels, omitting those with empty values and sorted by name as remote write
+// requires. Series labels should always be built with it.
+func seriesLabels(name string, labels ...prompb.Label) []prompb.Label {
+	ls := []prompb.Label{{Name: "__name__", Value: name}}
+	for _, l := range labels {
+		if l.Value != "" {
+			ls = append(ls, l)
+		}
+	}
+	return sortLabels(ls)
+}
+
+// sortLabels sorts ls by name in place, returning it.
+func sortLabels(ls []prompb.Label) []prompb.Label {
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].Name < ls[j].Name
+	})
+	return ls
+}
+
+// metricName returns name prefixed with metricNamespace when one is set.
+func metricName(name string) string {
+	if metricNamespace == "" {
+		return name
+	}
+	return metricNamespace + "_" + name
+}
@@ -0,0 +1,366 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type (
+	// fakePlug is a plug returning canned responses.
+	fakePlug struct {
+		usage map[string]interface{}
+		info  map[string]interface{}
+		err   error
+	}
+	// panickingPlug is a plug panicking on each request, as tapo.Tapo does
+	// on some malformed responses.
+	panickingPlug struct {
+		*fakePlug
+	}
+)
+
+func (f *fakePlug) GetEnergyUsage() (map[string]interface{}, error) {
+	return f.usage, f.err
+}
+
+func (f *fakePlug) DeviceInfo() (map[string]interface{}, error) {
+	return f.info, f.err
+}
+
+func (f *fakePlug) TurnOn() (map[string]interface{}, error) {
+	return nil, f.err
+}
+
+func (f *fakePlug) TurnOff() (map[string]interface{}, error) {
+	return nil, f.err
+}
+
+func (p panickingPlug) GetEnergyUsage() (map[string]interface{}, error) {
+	panic("index out of range")
+}
+
+// newFakePlug returns a fakePlug reporting a full set of readings.
+func newFakePlug() *fakePlug {
+	return &fakePlug{
+		usage: map[string]interface{}{
+			"error_code": float64(0),
+			"result": map[string]interface{}{
+				"current_power": float64(12345),
+				"voltage_mv":    float64(230500),
+				"current_ma":    float64(250),
+				"today_energy":  float64(100),
+				"month_energy":  float64(2000),
+			},
+		},
+		info: map[string]interface{}{
+			"error_code": float64(0),
+			"result": map[string]interface{}{
+				"device_on":               true,
+				"rssi":                    float64(-50),
+				"signal_level":            float64(3),
+				"overheated":              false,
+				"power_protection_status": "normal",
+				// base64 of "Fridge"
+				"nickname": "RnJpZGdl",
+				"on_time":  float64(3600),
+			},
+		},
+	}
+}
+
+// seriesStrings renders each sample of tss as name{labels} value@timestamp,
+// sorted.
+func seriesStrings(tss []prompb.TimeSeries) []string {
+	var out []string
+	for _, ts := range tss {
+		var name string
+		var labels []string
+		for _, l := range ts.Labels {
+			if l.Name == "__name__" {
+				name = l.Value
+				continue
+			}
+			labels = append(labels, fmt.Sprintf("%s=%q", l.Name, l.Value))
+		}
+		for _, s := range ts.Samples {
+			out = append(out, fmt.Sprintf("%s{%s} %g@%d", name, strings.Join(labels, ","), s.Value, s.Timestamp))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestCollect(t *testing.T) {
+	c := client{t: newFakePlug(), d: Device{Ip: "192.168.1.2", Name: "fridge"}}
+	now := time.UnixMilli(1669888800000)
+
+	tss, err := collect(c, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`current_power{ip="192.168.1.2",name="fridge"} 12345@1669888800000`,
+		`current{ip="192.168.1.2",name="fridge"} 0.25@1669888800000`,
+		`device_info{ip="192.168.1.2",name="fridge",nickname="Fridge"} 1@1669888800000`,
+		`device_on{ip="192.168.1.2",name="fridge"} 1@1669888800000`,
+		`energy_wh_total{ip="192.168.1.2",name="fridge"} 100@1669888800000`,
+		`month_energy{ip="192.168.1.2",name="fridge"} 2000@1669888800000`,
+		`overheated{ip="192.168.1.2",name="fridge"} 0@1669888800000`,
+		`power_protection_on{ip="192.168.1.2",name="fridge"} 0@1669888800000`,
+		`today_energy{ip="192.168.1.2",name="fridge"} 100@1669888800000`,
+		`uptime_seconds{ip="192.168.1.2",name="fridge"} 3600@1669888800000`,
+		`voltage{ip="192.168.1.2",name="fridge"} 230.5@1669888800000`,
+		`wifi_rssi_dbm{ip="192.168.1.2",name="fridge"} -50@1669888800000`,
+		`wifi_signal_level{ip="192.168.1.2",name="fridge"} 3@1669888800000`,
+	}
+	sort.Strings(want)
+	if got := seriesStrings(tss); !reflect.DeepEqual(got, want) {
+		t.Errorf("got series\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCollectErrorCode(t *testing.T) {
+	p := newFakePlug()
+	p.usage = map[string]interface{}{"error_code": float64(-1501)}
+	c := client{t: p, d: Device{Ip: "192.168.1.2"}}
+
+	if _, err := collect(c, time.Now()); !errors.Is(err, errAuth) {
+		t.Errorf("got error %v, want %v", err, errAuth)
+	}
+}
+
+func TestCollectMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		usage map[string]interface{}
+		err   error
+		panic bool
+	}{
+		{name: "request error", err: errors.New("unreachable")},
+		{name: "no result", usage: map[string]interface{}{"error_code": float64(0)}},
+		{name: "result not a map", usage: map[string]interface{}{"error_code": float64(0), "result": "none"}},
+		{name: "no current_power", usage: map[string]interface{}{"error_code": float64(0), "result": map[string]interface{}{}}},
+		{name: "current_power not a number", usage: map[string]interface{}{"error_code": float64(0), "result": map[string]interface{}{"current_power": "12"}}},
+		{name: "panic", panic: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newFakePlug()
+			p.usage, p.err = tc.usage, tc.err
+			c := client{t: p, d: Device{Ip: "192.168.1.2"}}
+			if tc.panic {
+				c.t = panickingPlug{p}
+			}
+			if tss, err := collect(c, time.Now()); err == nil {
+				t.Errorf("got series %v and no error", seriesStrings(tss))
+			}
+		})
+	}
+}
+
+func TestCollectWithoutDeviceInfo(t *testing.T) {
+	p := newFakePlug()
+	p.info = map[string]interface{}{"error_code": float64(0)}
+	c := client{t: p, d: Device{Ip: "192.168.1.2"}}
+
+	// the energy usage is still collected
+	tss, err := collect(c, time.UnixMilli(1669888800000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := seriesStrings(tss); !contains(got, `current_power{ip="192.168.1.2"} 12345@1669888800000`) {
+		t.Errorf("missing current_power in\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestPollFailure(t *testing.T) {
+	p := newFakePlug()
+	p.err = errors.New("unreachable")
+	ip := "192.168.1.3"
+	pl := &poller{c: client{t: p, d: Device{Ip: ip, Name: "kettle"}}, opts: collectOptions{interval: 60}}
+	q := make(chan prompb.TimeSeries, 10)
+	failures := testutil.ToFloat64(collectionsTotal.WithLabelValues(ip, "failure"))
+	clk := newFakeClock(time.UnixMilli(1669888800000))
+
+	pl.poll(clk, queues{q}, nil)
+	want := []string{
+		`collection_errors_total{ip="192.168.1.3",name="kettle"} 1@1669888800000`,
+		`up{ip="192.168.1.3",name="kettle"} 0@1669888800000`,
+	}
+	if got := seriesStrings(drain(q)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got series\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := testutil.ToFloat64(collectionsTotal.WithLabelValues(ip, "failure")) - failures; got != 1 {
+		t.Errorf("got %g failed collections, want 1", got)
+	}
+
+	// the error count survives the device recovering
+	p.err = nil
+	pl.poll(clk, queues{q}, nil)
+	got := seriesStrings(drain(q))
+	for _, s := range []string{
+		`collection_errors_total{ip="192.168.1.3",name="kettle"} 1@1669888800000`,
+		`poll_interval_seconds{ip="192.168.1.3",name="kettle"} 60@1669888800000`,
+		`up{ip="192.168.1.3",name="kettle"} 1@1669888800000`,
+	} {
+		if !contains(got, s) {
+			t.Errorf("missing %s in\n%s", s, strings.Join(got, "\n"))
+		}
+	}
+}
+
+// drain returns the time-series queued on q.
+func drain(q chan prompb.TimeSeries) []prompb.TimeSeries {
+	var tss []prompb.TimeSeries
+	for {
+		select {
+		case ts := <-q:
+			tss = append(tss, ts)
+		default:
+			return tss
+		}
+	}
+}
+
+// contains reports whether ss contains s.
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPollDuringReconnectBackoff(t *testing.T) {
+	ip := "192.168.1.4"
+	clk := newFakeClock(time.UnixMilli(1669888800000))
+	pl := &poller{
+		c:             client{t: newFakePlug(), d: Device{Ip: ip}},
+		opts:          collectOptions{interval: 60},
+		failures:      reconnectAfter,
+		errorsTotal:   reconnectAfter,
+		nextReconnect: clk.Now().Add(time.Minute),
+	}
+	q := make(chan prompb.TimeSeries, 10)
+	failures := testutil.ToFloat64(collectionsTotal.WithLabelValues(ip, "failure"))
+
+	pl.poll(clk, queues{q}, nil)
+	want := []string{
+		`collection_errors_total{ip="192.168.1.4"} 4@1669888800000`,
+		`up{ip="192.168.1.4"} 0@1669888800000`,
+	}
+	if got := seriesStrings(drain(q)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got series\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := testutil.ToFloat64(collectionsTotal.WithLabelValues(ip, "failure")) - failures; got != 1 {
+		t.Errorf("got %g failed collections, want 1", got)
+	}
+}
+
+// staleCount returns the number of staleness markers in tss.
+func staleCount(tss []prompb.TimeSeries) int {
+	var n int
+	for _, ts := range tss {
+		for _, s := range ts.Samples {
+			if value.IsStaleNaN(s.Value) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestPollStaleAfter(t *testing.T) {
+	clk := newFakeClock(time.UnixMilli(1669888800000))
+	q := make(chan prompb.TimeSeries, 100)
+
+	// polls succeeding in turn are never stale
+	p := newFakePlug()
+	pl := &poller{c: client{t: p, d: Device{Ip: "192.168.1.5"}}, opts: collectOptions{interval: 60, staleAfter: 1, staleMarkers: true}}
+	for i := 0; i < 3; i++ {
+		pl.poll(clk, queues{q}, nil)
+		if n := staleCount(drain(q)); n != 0 {
+			t.Errorf("got %d staleness markers for successful poll %d", n, i+1)
+		}
+	}
+
+	// markers follow the staleAfter'th failure, not the poll before
+	pl = &poller{c: client{t: p, d: Device{Ip: "192.168.1.5"}}, opts: collectOptions{interval: 60, staleAfter: 2, staleMarkers: true}}
+	pl.poll(clk, queues{q}, nil)
+	reading := len(drain(q))
+	p.err = errors.New("unreachable")
+	pl.poll(clk, queues{q}, nil)
+	p.err = nil
+	pl.poll(clk, queues{q}, nil)
+	if n := staleCount(drain(q)); n != 0 {
+		t.Errorf("got %d staleness markers recovering after 1 failure", n)
+	}
+	p.err = errors.New("unreachable")
+	pl.poll(clk, queues{q}, nil)
+	if n := staleCount(drain(q)); n != 0 {
+		t.Errorf("got %d staleness markers after 1 failure", n)
+	}
+	pl.poll(clk, queues{q}, nil)
+	if n := staleCount(drain(q)); n != reading {
+		t.Errorf("got %d staleness markers after 2 failures, want %d", n, reading)
+	}
+	p.err = nil
+	pl.poll(clk, queues{q}, nil)
+	if tss := drain(q); len(tss) != reading || staleCount(tss) != 0 {
+		t.Errorf("got %d time-series with %d staleness markers after recovering, want %d without", len(tss), staleCount(tss), reading)
+	}
+}
+
+func TestPollCircuitBreaker(t *testing.T) {
+	clk := newFakeClock(time.UnixMilli(1669888800000))
+	q := make(chan prompb.TimeSeries, 100)
+	p := newFakePlug()
+	p.err = errors.New("unreachable")
+	defer func(f func(string, string, string) (plug, error)) { newPlug = f }(newPlug)
+	newPlug = func(string, string, string) (plug, error) { return p, nil }
+	const ip = "192.168.1.7"
+	defer circuitOpen.DeleteLabelValues(ip)
+
+	pl := &poller{c: client{t: p, d: Device{Ip: ip}}, opts: collectOptions{interval: 60, breakerAfter: 2, probeInterval: 300}}
+	for i := 0; i < 2; i++ {
+		pl.poll(clk, queues{q}, nil)
+		clk.Advance(time.Minute)
+	}
+	drain(q)
+	if !pl.open || testutil.ToFloat64(circuitOpen.WithLabelValues(ip)) != 1 {
+		t.Fatalf("got circuit open %t after 2 failures, want open", pl.open)
+	}
+	if got, want := pl.next(clk.Now()), clk.Now().Add(5*time.Minute); !got.Equal(want) {
+		t.Errorf("got next probe at %s, want %s", got, want)
+	}
+
+	// a failed probe keeps the circuit open
+	clk.Advance(5 * time.Minute)
+	pl.poll(clk, queues{q}, nil)
+	drain(q)
+	if !pl.open || testutil.ToFloat64(circuitOpen.WithLabelValues(ip)) != 1 {
+		t.Errorf("got circuit open %t after a failed probe, want open", pl.open)
+	}
+
+	// a successful probe closes it, and polling resumes every interval
+	clk.Advance(5 * time.Minute)
+	p.err = nil
+	pl.poll(clk, queues{q}, nil)
+	if pl.open || testutil.ToFloat64(circuitOpen.WithLabelValues(ip)) != 0 {
+		t.Errorf("got circuit open %t after a successful probe, want closed", pl.open)
+	}
+	if n := len(drain(q)); n == 0 {
+		t.Error("got no time-series from a successful probe")
+	}
+	if got, want := pl.next(clk.Now()), clk.Now().Add(time.Minute); !got.Equal(want) {
+		t.Errorf("got next poll at %s after closing, want %s", got, want)
+	}
+}
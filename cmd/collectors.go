@@ -0,0 +1,452 @@
+package cmd
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idleWait is how long the scheduler sleeps when no devices are being
+// polled.
+const idleWait = time.Minute
+
+type (
+	// collectors schedules polls of each device, running them on a bounded
+	// pool of workers so that the number of simultaneous device requests
+	// does not grow with the number of devices.
+	collectors struct {
+		wg      *sync.WaitGroup
+		clk     clock
+		opts    collectOptions
+		workers int
+		metrics queues
+		gauges  *gaugeSet
+		// devices are the configured devices, whose order sets the offset
+		// of each when spreading polls
+		devices []Device
+		// running is the device being polled for each device by ip
+		running map[string]Device
+		add     chan *poller
+		remove  chan string
+		update  chan settings
+		stopped chan bool
+	}
+	// settings are the device and options a poller polls with, replaced on
+	// reload without disturbing its session or failure state.
+	settings struct {
+		d    Device
+		opts collectOptions
+		// offset is the offset of each poll within the interval when
+		// spreading polls
+		offset time.Duration
+	}
+	// collectOptions control how a device is polled.
+	collectOptions struct {
+		// interval is the poll interval in seconds
+		interval int
+		// jitter is the fraction of interval each poll is randomly moved by
+		jitter float64
+		// staleAfter is the number of consecutive missed polls after which
+		// the device's time-series are marked stale, 0 disables
+		staleAfter int
+		// breakerAfter is the number of consecutive failures after which
+		// the device is only probed every probeInterval seconds, 0 disables
+		breakerAfter  int
+		probeInterval int
+		// alignTimestamps truncates sample timestamps to the interval
+		alignTimestamps bool
+		// collectOnStart polls a device as soon as it is started rather
+		// than after its first interval
+		collectOnStart bool
+		// spread polls each device at a fixed offset within the interval
+		// by its position in the devices, in place of jitter
+		spread bool
+		// staleMarkers sends staleness markers to metrics, only Prometheus
+		// remote write understands them
+		staleMarkers bool
+		// connectTimeout bounds connecting to a device started without a
+		// session
+		connectTimeout time.Duration
+	}
+)
+
+func newCollectors(wg *sync.WaitGroup, clk clock, opts collectOptions, devices []Device, workers int, metrics queues, gauges *gaugeSet) *collectors {
+	return &collectors{
+		wg:      wg,
+		clk:     clk,
+		opts:    opts,
+		devices: devices,
+		workers: workers,
+		metrics: metrics,
+		gauges:  gauges,
+		running: make(map[string]Device),
+		add:     make(chan *poller),
+		remove:  make(chan string),
+		update:  make(chan settings),
+	}
+}
+
+// newCollectOptions returns the collectOptions configured in conf.
+func newCollectOptions(conf Config) collectOptions {
+	return collectOptions{
+		interval:        int(conf.Interval),
+		jitter:          conf.Jitter,
+		staleAfter:      conf.StaleAfter,
+		breakerAfter:    conf.BreakerAfter,
+		probeInterval:   conf.ProbeInterval,
+		alignTimestamps: conf.AlignTimestamps,
+		collectOnStart:  conf.CollectOnStart,
+		spread:          conf.Spread,
+		staleMarkers:    conf.Output == OutputPrometheus,
+		connectTimeout:  time.Duration(conf.ConnectTimeout) * time.Second,
+	}
+}
+
+// run starts the scheduler and workers, which run until stop is closed.
+// Devices are polled once started.
+func (cs *collectors) run(stop chan bool) {
+	cs.stopped = stop
+	jobs := make(chan *poller)
+	// buffered so that workers finishing a poll after the scheduler has
+	// stopped do not block
+	done := make(chan *poller, cs.workers)
+	cs.wg.Add(cs.workers + 1)
+	for i := 0; i < cs.workers; i++ {
+		go cs.work(jobs, done)
+	}
+	go cs.schedule(stop, jobs, done)
+}
+
+// schedule sends each device's poller to jobs when it is due, rescheduling it
+// once the poll is done.
+func (cs *collectors) schedule(stop chan bool, jobs chan *poller, done chan *poller) {
+	var ok bool
+	var ready []*poller
+
+	defer cs.wg.Done()
+
+	pollers := make(map[string]*poller)
+	due := make(map[*poller]time.Time)
+	// changes holds the settings of pollers updated during a poll, applied
+	// once it is done
+	changes := make(map[*poller]settings)
+	ticker := cs.clk.NewTicker(idleWait)
+
+	for {
+		// re-arm the ticker for the earliest due poll
+		wait := idleWait
+		for _, t := range due {
+			if d := t.Sub(cs.clk.Now()); d < wait {
+				wait = d
+			}
+		}
+		if wait <= 0 {
+			wait = time.Millisecond
+		}
+		ticker.Reset(wait)
+
+		// only offer a job when one is ready
+		var send chan *poller
+		var next *poller
+		if len(ready) > 0 {
+			send, next = jobs, ready[0]
+		}
+
+		select {
+		case _, ok = <-stop:
+			if !ok {
+				ticker.Stop()
+				close(jobs)
+				log.Info("stopping collectors")
+				return
+			}
+		case p := <-cs.add:
+			ip := p.c.d.Ip
+			pollers[ip] = p
+			// the first poll is delayed by up to jitter of the interval so
+			// that devices started together do not stay in step
+			due[p] = cs.clk.Now().Add(p.period() + time.Duration(rand.Float64()*p.opts.jitter*float64(p.period())))
+			if p.opts.spread {
+				due[p] = nextSlot(cs.clk.Now(), p.period(), p.offset)
+			}
+			if p.opts.collectOnStart {
+				// later polls are still jittered
+				due[p] = cs.clk.Now()
+			}
+		case ip := <-cs.remove:
+			if p, ok := pollers[ip]; ok {
+				delete(pollers, ip)
+				delete(due, p)
+				delete(changes, p)
+				for i := range ready {
+					if ready[i] == p {
+						ready = append(ready[:i], ready[i+1:]...)
+						break
+					}
+				}
+				deviceLog(ip).Infof("stopped polling %s", ip)
+			}
+		case s := <-cs.update:
+			p, ok := pollers[s.d.Ip]
+			if !ok {
+				break
+			}
+			if _, waiting := due[p]; waiting {
+				p.apply(s)
+				due[p] = p.next(cs.clk.Now())
+			} else if isReady(ready, p) {
+				p.apply(s)
+			} else {
+				// being polled by a worker
+				changes[p] = s
+			}
+		case send <- next:
+			ready = ready[1:]
+		case p := <-done:
+			// a device stopped or restarted during its poll is dropped
+			if pollers[p.c.d.Ip] == p {
+				if s, ok := changes[p]; ok {
+					p.apply(s)
+					delete(changes, p)
+				}
+				due[p] = p.next(cs.clk.Now())
+			}
+		case <-ticker.C():
+			now := cs.clk.Now()
+			for p, t := range due {
+				if !t.After(now) {
+					delete(due, p)
+					ready = append(ready, p)
+				}
+			}
+			if len(ready) > cs.workers {
+				log.Debugf("%d devices are waiting for a worker", len(ready))
+			}
+		}
+	}
+}
+
+// work polls each poller received on jobs, sending it to done afterwards.
+func (cs *collectors) work(jobs chan *poller, done chan *poller) {
+	defer cs.wg.Done()
+	for p := range jobs {
+		p.poll(cs.clk, cs.metrics, cs.gauges)
+		done <- p
+	}
+}
+
+// isReady reports whether p is in ready.
+func isReady(ready []*poller, p *poller) bool {
+	for _, r := range ready {
+		if r == p {
+			return true
+		}
+	}
+	return false
+}
+
+// start begins polling c.
+func (cs *collectors) start(c client) {
+	s := cs.settings(c.d)
+	p := &poller{c: c}
+	p.apply(s)
+	p.backoff = p.period()
+	s.log()
+	select {
+	case cs.add <- p:
+		cs.running[c.d.Ip] = c.d
+	case <-cs.stopped:
+	}
+}
+
+// restart replaces the settings of the running poller of d, keeping its
+// session and failure state.
+func (cs *collectors) restart(d Device) {
+	s := cs.settings(d)
+	s.log()
+	select {
+	case cs.update <- s:
+		cs.running[d.Ip] = d
+	case <-cs.stopped:
+	}
+}
+
+// settings returns the settings d is polled with.
+func (cs *collectors) settings(d Device) settings {
+	opts := cs.opts
+	opts.interval = d.effectiveInterval(opts.interval)
+	s := settings{d: d, opts: opts}
+	if opts.spread {
+		s.offset = spreadOffset(cs.devices, d.Ip, time.Duration(opts.interval)*time.Second)
+	}
+	return s
+}
+
+// log logs how the device of s is polled.
+func (s settings) log() {
+	if s.opts.spread {
+		deviceLog(s.d.Ip).Infof("polling %s every %ds at offset %s", s.d.Ip, s.opts.interval, s.offset)
+		return
+	}
+	deviceLog(s.d.Ip).Infof("polling %s every %ds", s.d.Ip, s.opts.interval)
+}
+
+// spreadOffset returns the offset within interval of the device with ip,
+// spreading devices evenly in the order they are configured.
+func spreadOffset(devices []Device, ip string, interval time.Duration) time.Duration {
+	for i, d := range devices {
+		if d.Ip == ip {
+			return interval * time.Duration(i) / time.Duration(len(devices))
+		}
+	}
+	return 0
+}
+
+// nextSlot returns the first time after now that is offset past a multiple
+// of period.
+func nextSlot(now time.Time, period time.Duration, offset time.Duration) time.Time {
+	t := now.Truncate(period).Add(offset)
+	if !t.After(now) {
+		t = t.Add(period)
+	}
+	return t
+}
+
+// stop stops polling the device with ip.
+func (cs *collectors) stop(ip string) {
+	if _, ok := cs.running[ip]; ok {
+		select {
+		case cs.remove <- ip:
+		case <-cs.stopped:
+		}
+		delete(cs.running, ip)
+	}
+}
+
+// reload re-reads the config file and reconciles the devices being polled with
+// its Devices, returning the config now in effect. The current config is kept
+// if the new one cannot be loaded. Added devices, and those with changed
+// credentials, are started without a session and connected to by their first
+// poll, so that reloading does not wait on unreachable devices.
+func (cs *collectors) reload(current Config) Config {
+	var added, removed, updated []string
+
+	conf, err := loadConfig()
+	if err != nil {
+		log.Errorf("could not reload config, keeping current config: %s", err)
+		return current
+	}
+	// as on start, so that only settings changed in the file differ
+	conf = withDryRun(conf, current.dryRun)
+
+	// only Devices, the collection settings and, when remote writing to
+	// Prometheus, the remote write client settings are applied on reload,
+	// everything else requires a restart
+	next := withCollectionSettings(current, conf)
+	if current.Output == OutputPrometheus {
+		if len(conf.Prometheus.AdditionalEndpoints) == len(current.Prometheus.AdditionalEndpoints) {
+			next = withRemoteWriteSettings(next, conf)
+		} else {
+			log.Warning("additionalEndpoints added or removed, restart tapmon to apply Prometheus settings")
+		}
+	}
+	if changed := changedSettings(reflect.ValueOf(next), reflect.ValueOf(conf), ""); len(changed) > 0 {
+		log.Warningf("restart tapmon to apply changes to %s", strings.Join(changed, ", "))
+	}
+	if next.RequestTimeout != current.RequestTimeout || next.Metrics != current.Metrics {
+		log.Infof("request settings changed, requestTimeout %d, metrics %+v", next.RequestTimeout, next.Metrics)
+		setCollection(next)
+	}
+	conf = next
+
+	devices := make(map[string]Device)
+	for _, d := range conf.Devices {
+		devices[d.Ip] = d
+	}
+	for ip := range cs.running {
+		if _, ok := devices[ip]; !ok {
+			cs.stop(ip)
+			if cs.gauges != nil {
+				cs.gauges.delete(ip)
+			}
+			collectionsTotal.DeletePartialMatch(prometheus.Labels{"ip": ip})
+			circuitOpen.DeleteLabelValues(ip)
+			removed = append(removed, ip)
+		}
+	}
+
+	opts := newCollectOptions(conf)
+	optsChanged := opts != cs.opts
+	if optsChanged {
+		log.Infof("collection settings changed, interval %d, jitter %g, staleAfter %d, breakerAfter %d, probeInterval %d, alignTimestamps %t", opts.interval, opts.jitter, opts.staleAfter, opts.breakerAfter, opts.probeInterval, opts.alignTimestamps)
+		cs.opts = opts
+	}
+	cs.devices = conf.Devices
+
+	for _, d := range conf.Devices {
+		r, ok := cs.running[d.Ip]
+		switch {
+		case !ok:
+			cs.start(client{d: d})
+			added = append(added, d.Ip)
+		case d.Username != r.Username || d.Password != r.Password:
+			cs.stop(d.Ip)
+			cs.start(client{d: d})
+			updated = append(updated, d.Ip)
+		case d != r || optsChanged:
+			if d != r {
+				updated = append(updated, d.Ip)
+			}
+			cs.restart(d)
+		}
+	}
+
+	log.Infof("reloaded config: added %v, removed %v, updated %v", added, removed, updated)
+	return conf
+}
+
+// withCollectionSettings returns conf with the settings applied on reload
+// taken from src.
+func withCollectionSettings(conf Config, src Config) Config {
+	conf.Devices, conf.Interval, conf.Jitter, conf.StaleAfter = src.Devices, src.Interval, src.Jitter, src.StaleAfter
+	conf.BreakerAfter, conf.ProbeInterval, conf.AlignTimestamps = src.BreakerAfter, src.ProbeInterval, src.AlignTimestamps
+	conf.CollectOnStart, conf.Spread = src.CollectOnStart, src.Spread
+	conf.RequestTimeout, conf.Metrics = src.RequestTimeout, src.Metrics
+	return conf
+}
+
+// changedSettings returns the names of the exported settings differing
+// between a and b, nested settings being named by their path such as
+// Prometheus.Namespace.
+func changedSettings(a, b reflect.Value, prefix string) []string {
+	var changed []string
+
+	for i := 0; i < a.NumField(); i++ {
+		f := a.Type().Field(i)
+		switch {
+		case !f.IsExported():
+		case f.Type.Kind() == reflect.Struct:
+			changed = append(changed, changedSettings(a.Field(i), b.Field(i), prefix+f.Name+".")...)
+		case !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()):
+			changed = append(changed, prefix+f.Name)
+		}
+	}
+	return changed
+}
+
+// withRemoteWriteSettings returns conf with the remote write client settings
+// applied on reload taken from src.
+func withRemoteWriteSettings(conf Config, src Config) Config {
+	p, s := &conf.Prometheus, src.Prometheus
+	p.Endpoint, p.Username, p.Password, p.PasswordFile = s.Endpoint, s.Username, s.Password, s.PasswordFile
+	p.BearerToken, p.BearerTokenFile, p.TLS, p.Headers = s.BearerToken, s.BearerTokenFile, s.TLS, s.Headers
+	p.ProxyURL = s.ProxyURL
+	p.ExternalLabels, p.WriteRelabelConfigs, p.Compression, p.ClientName = s.ExternalLabels, s.WriteRelabelConfigs, s.Compression, s.ClientName
+	p.MaxRetries, p.BackoffInitial, p.BackoffMax = s.MaxRetries, s.BackoffInitial, s.BackoffMax
+	p.AdditionalEndpoints = s.AdditionalEndpoints
+	return conf
+}
@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nextUp returns the timestamp of the next up sample queued on q, marking a
+// poll.
+func nextUp(t *testing.T, q chan prompb.TimeSeries) int64 {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ts := <-q:
+			if labelValue(ts.Labels, "__name__") == upMetric.fullName() {
+				return ts.Samples[0].Timestamp
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a poll")
+		}
+	}
+}
+
+func TestCollectorsSchedule(t *testing.T) {
+	// a multiple of the interval, so that spread offsets start from it
+	start := time.Unix(1669888800, 0)
+	devices := []Device{{Ip: "192.168.1.2"}, {Ip: "192.168.1.3"}}
+
+	for _, tc := range []struct {
+		name   string
+		opts   collectOptions
+		device Device
+		// want are the times of the first polls relative to start
+		want []time.Duration
+	}{
+		{
+			name:   "interval",
+			opts:   collectOptions{interval: 10},
+			device: devices[0],
+			want:   []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second},
+		},
+		{
+			name:   "device interval",
+			opts:   collectOptions{interval: 10},
+			device: Device{Ip: "192.168.1.2", Interval: 30},
+			want:   []time.Duration{30 * time.Second, 60 * time.Second, 90 * time.Second},
+		},
+		{
+			name:   "spread",
+			opts:   collectOptions{interval: 10, spread: true},
+			device: devices[1],
+			want:   []time.Duration{5 * time.Second, 15 * time.Second, 25 * time.Second},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+
+			clk := newFakeClock(start)
+			q := make(chan prompb.TimeSeries, 100)
+			stop := make(chan bool)
+			cs := newCollectors(&wg, clk, tc.opts, devices, 1, queues{q}, nil)
+			cs.run(stop)
+			cs.start(client{t: newFakePlug(), d: tc.device})
+
+			for _, offset := range tc.want {
+				due := start.Add(offset)
+				waitFor(t, "the next poll to be scheduled at "+due.String(), func() bool {
+					return clk.nextTick().Equal(due)
+				})
+				clk.Advance(due.Sub(clk.Now()))
+				if got := nextUp(t, q); got != due.UnixMilli() {
+					t.Errorf("got poll at %s, want %s", time.UnixMilli(got), due)
+				}
+			}
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+func TestNextSlot(t *testing.T) {
+	start := time.Unix(1669888800, 0)
+	for _, tc := range []struct {
+		now    time.Duration
+		offset time.Duration
+		want   time.Duration
+	}{
+		{now: 0, offset: 0, want: 10 * time.Second},
+		{now: 0, offset: 5 * time.Second, want: 5 * time.Second},
+		{now: 5 * time.Second, offset: 5 * time.Second, want: 15 * time.Second},
+		{now: 7 * time.Second, offset: 5 * time.Second, want: 15 * time.Second},
+	} {
+		if got := nextSlot(start.Add(tc.now), 10*time.Second, tc.offset); !got.Equal(start.Add(tc.want)) {
+			t.Errorf("nextSlot at %s with offset %s got %s, want %s", tc.now, tc.offset, got.Sub(start), tc.want)
+		}
+	}
+}
+
+func TestCollectorsRestart(t *testing.T) {
+	var wg sync.WaitGroup
+
+	start := time.Unix(1669888800, 0)
+	d := Device{Ip: "192.168.1.5", Name: "kettle"}
+	p := newFakePlug()
+	p.err = errors.New("unreachable")
+	clk := newFakeClock(start)
+	q := make(chan prompb.TimeSeries, 100)
+	stop := make(chan bool)
+	cs := newCollectors(&wg, clk, collectOptions{interval: 10}, []Device{d}, 1, queues{q}, nil)
+	cs.run(stop)
+	cs.start(client{t: p, d: d})
+
+	poll := func(due time.Time) []string {
+		t.Helper()
+		waitFor(t, "the next poll to be scheduled at "+due.String(), func() bool {
+			return clk.nextTick().Equal(due)
+		})
+		clk.Advance(due.Sub(clk.Now()))
+		var tss []prompb.TimeSeries
+		for timeout := time.After(5 * time.Second); ; {
+			select {
+			case ts := <-q:
+				tss = append(tss, ts)
+				if labelValue(ts.Labels, "__name__") == upMetric.fullName() {
+					return seriesStrings(tss)
+				}
+			case <-timeout:
+				t.Fatal("timed out waiting for a poll")
+			}
+		}
+	}
+	poll(start.Add(10 * time.Second))
+
+	// the renamed device is polled every 30s by the same poller, keeping
+	// its error count
+	d.Name, d.Interval = "teapot", 30
+	cs.restart(d)
+	got := poll(start.Add(40 * time.Second))
+	if want := `collection_errors_total{ip="192.168.1.5",name="teapot"} 2@1669888840000`; !contains(got, want) {
+		t.Errorf("missing %s in\n%s", want, strings.Join(got, "\n"))
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// loadTestConfig loads a config file named name containing content.
+func loadTestConfig(t *testing.T, name string, content string) Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigFile(path)
+	conf, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func TestCollectorsReloadDryRun(t *testing.T) {
+	var wg sync.WaitGroup
+
+	conf := loadTestConfig(t, "tapmon.yaml", `
+Devices:
+  - Ip: 192.168.1.6
+    Username: user
+    Password: secret
+Prometheus:
+  Endpoint: http://localhost:9090/api/v1/write
+  BufferPath: /var/lib/tapmon
+`)
+	conf = withDryRun(conf, true)
+	stop := make(chan bool)
+	cs := newCollectors(&wg, newFakeClock(time.Unix(1669888800, 0)), newCollectOptions(conf), conf.Devices, 1, queues{make(chan prompb.TimeSeries, 100)}, nil)
+	cs.run(stop)
+	cs.start(client{t: newFakePlug(), d: conf.Devices[0]})
+
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	if got := cs.reload(conf); !reflect.DeepEqual(got, conf) {
+		t.Errorf("got config %+v after reloading an unchanged file, want %+v", got, conf)
+	}
+	for _, e := range hook.AllEntries() {
+		if e.Level <= log.WarnLevel {
+			t.Errorf("got %s reloading an unchanged file: %s", e.Level, e.Message)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestCollectorsReloadSettings(t *testing.T) {
+	var wg sync.WaitGroup
+
+	const file = `
+Devices:
+  - Ip: 192.168.1.6
+    Username: user
+    Password: secret
+Prometheus:
+  Endpoint: http://localhost:9090/api/v1/write
+  BufferPath: /var/lib/tapmon
+`
+	conf := loadTestConfig(t, "tapmon.yaml", file)
+	defer setCollection(conf)
+	stop := make(chan bool)
+	cs := newCollectors(&wg, newFakeClock(time.Unix(1669888800, 0)), newCollectOptions(conf), conf.Devices, 1, queues{make(chan prompb.TimeSeries, 100)}, nil)
+	cs.run(stop)
+
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	loadTestConfig(t, "tapmon.yaml", file+`
+  Namespace: home
+Workers: 8
+RequestTimeout: 3
+Metrics:
+  Wifi: false
+`)
+	got := cs.reload(conf)
+	if got.RequestTimeout != 3 || got.Metrics.Wifi {
+		t.Errorf("got RequestTimeout %d and Metrics %+v after reloading, want them applied", got.RequestTimeout, got.Metrics)
+	}
+	if d := conf.Devices[0].effectiveRequestTimeout(); d != 3*time.Second {
+		t.Errorf("got request timeout %s after reloading, want 3s", d)
+	}
+	if enabledMetrics.Load().Wifi {
+		t.Error("got Wifi metrics enabled after reloading, want disabled")
+	}
+	var warnings []string
+	for _, e := range hook.AllEntries() {
+		if e.Level <= log.WarnLevel {
+			warnings = append(warnings, e.Message)
+		}
+	}
+	if want := []string{"restart tapmon to apply changes to Workers, Prometheus.Namespace"}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("got warnings %q, want %q", warnings, want)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestCollectorsReloadAdditionalEndpoints(t *testing.T) {
+	var wg sync.WaitGroup
+
+	const file = `
+Devices:
+  - Ip: 192.168.1.6
+    Username: user
+    Password: secret
+Prometheus:
+  Endpoint: http://localhost:9090/api/v1/write
+  BufferPath: /var/lib/tapmon
+`
+	conf := loadTestConfig(t, "tapmon.yaml", file)
+	stop := make(chan bool)
+	cs := newCollectors(&wg, newFakeClock(time.Unix(1669888800, 0)), newCollectOptions(conf), conf.Devices, 1, queues{make(chan prompb.TimeSeries, 100)}, nil)
+	cs.run(stop)
+
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	loadTestConfig(t, "tapmon.yaml", file+`
+  AdditionalEndpoints:
+    - Endpoint: https://longterm/api/v1/push
+`)
+	if got := cs.reload(conf); !reflect.DeepEqual(got.Prometheus, conf.Prometheus) {
+		t.Errorf("got Prometheus settings %+v after adding an endpoint, want them unchanged", got.Prometheus)
+	}
+	var warnings []string
+	for _, e := range hook.AllEntries() {
+		if e.Level <= log.WarnLevel {
+			warnings = append(warnings, e.Message)
+		}
+	}
+	want := []string{
+		"additionalEndpoints added or removed, restart tapmon to apply Prometheus settings",
+		"restart tapmon to apply changes to Prometheus.AdditionalEndpoints",
+	}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("got warnings %q, want %q", warnings, want)
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// completeConfig completes the config file argument with files of a
+// supported format, unless given by the --config flag.
+func completeConfig(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if path, _ := cmd.Flags().GetString("config"); len(args) == 0 && path == "" {
+		return configFormats, cobra.ShellCompDirectiveFilterFileExt
+	}
+	return nil, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeSet completes the arguments of set, offering the names and ips of
+// the devices in the config file given by --config or as the first argument,
+// or only on and off once the config is given when --group is set.
+func completeSet(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if path, _ := cmd.Flags().GetString("config"); path != "" {
+		args = append([]string{path}, args...)
+	}
+	if group, _ := cmd.Flags().GetString("group"); group != "" && len(args) > 0 {
+		args = append([]string{args[0], "*"}, args[1:]...)
+	}
+	switch len(args) {
+	case 0:
+		return completeConfig(cmd, args, toComplete)
+	case 1:
+		if selectors := deviceSelectors(args[0]); selectors != nil {
+			return append(selectors, "*"), cobra.ShellCompDirectiveNoFileComp
+		}
+	case 2:
+		return []string{"on", "off"}, cobra.ShellCompDirectiveNoFileComp
+	}
+	return nil, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeDump completes the arguments of dump, offering the names and ips of
+// the devices in the config file given by --config or as the first argument.
+func completeDump(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if path, _ := cmd.Flags().GetString("config"); path != "" {
+		args = append([]string{path}, args...)
+	}
+	switch len(args) {
+	case 0:
+		return completeConfig(cmd, args, toComplete)
+	case 1:
+		return deviceSelectors(args[0]), cobra.ShellCompDirectiveNoFileComp
+	}
+	return nil, cobra.ShellCompDirectiveNoFileComp
+}
+
+// deviceSelectors returns the names and ips of the devices in the config
+// file at path, or none if it cannot be read.
+func deviceSelectors(path string) []string {
+	var devices []Device
+	var selectors []string
+
+	viper.SetConfigFile(path)
+	if viper.ReadInConfig() != nil || viper.UnmarshalKey("Devices", &devices, decodeHook) != nil {
+		return nil
+	}
+	for _, d := range devices {
+		if d.Name != "" {
+			selectors = append(selectors, d.Name)
+		}
+		selectors = append(selectors, d.Ip)
+	}
+	return selectors
+}
@@ -0,0 +1,1035 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mitchellh/mapstructure"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	Config struct {
+		Interval Seconds
+		// Jitter is the fraction of Interval by which each poll is randomly
+		// moved earlier or later
+		Jitter float64
+		// StaleAfter is the number of consecutive missed polls after which a
+		// device's time-series are marked stale, 0 disables
+		StaleAfter int
+		// BreakerAfter is the number of consecutive failures after which a
+		// device is only probed every ProbeInterval seconds until it
+		// responds, 0 disables
+		BreakerAfter  int
+		ProbeInterval int
+		// AlignTimestamps truncates the timestamp of each sample to the
+		// poll interval rather than using the time the device responded
+		AlignTimestamps bool
+		// Spread polls each device at a fixed offset within the interval,
+		// the devices being spread evenly in the order configured. Jitter
+		// defaults to 0 and must be 0 when set
+		Spread bool
+		// CollectOnStart polls each device as soon as it is started so the
+		// first reading does not wait for a full interval
+		CollectOnStart bool
+		// Workers bounds the number of devices polled at the same time
+		Workers int
+		// ConnectConcurrency bounds the number of devices connected to at
+		// the same time on startup, each within ConnectTimeout seconds
+		ConnectConcurrency int
+		ConnectTimeout     int
+		// ConnectRetries is the number of times connecting to a device on
+		// startup is retried, ConnectRetryDelay seconds apart doubling
+		// after each attempt
+		ConnectRetries    int
+		ConnectRetryDelay int
+		// RequestTimeout bounds each request to a device in seconds
+		RequestTimeout int
+		// ShutdownTimeout bounds the final flush on stopping in seconds,
+		// after which what is left is buffered or dropped
+		ShutdownTimeout int
+		// Defaults are inherited by each of Devices that does not set them
+		Defaults struct {
+			Username string
+			Password string
+			// PasswordFile is read for the Password rather than setting it
+			// inline
+			PasswordFile string
+		}
+		Devices []Device
+		// Metrics enables or disables each group of collected metrics
+		Metrics MetricToggles
+		// UserAgent identifies requests to the output
+		UserAgent string
+		// CheckOutput makes an empty write to each output on startup,
+		// exiting if it fails
+		CheckOutput bool
+		// Output selects the backend time-series are pushed to
+		Output     string
+		Prometheus struct {
+			Endpoint string
+			Username string
+			Password string
+			// PasswordFile is read for the Password rather than setting it
+			// inline
+			PasswordFile  string
+			FlushInterval Seconds
+			QueueCapacity int
+			// MaxSamplesPerSend bounds the size of each write request, a
+			// flush is split into as many requests as needed
+			MaxSamplesPerSend int
+			// MaxRetries is the number of times a recoverable write error is
+			// retried within a flush, with a delay starting at BackoffInitial
+			// seconds and doubling up to BackoffMax seconds
+			MaxRetries      int
+			BackoffInitial  int
+			BackoffMax      int
+			BufferPath      string
+			BufferRetention int
+			// MaxSampleAge drops samples older than it in seconds before
+			// each flush, such as those a long outage left retained that
+			// the endpoint would reject as too old, 0 disables
+			MaxSampleAge   int
+			ExternalLabels map[string]string
+			// WriteRelabelConfigs are Prometheus write_relabel_configs
+			// applied to each time-series before it is remote written
+			WriteRelabelConfigs []map[string]interface{}
+			// Headers are added to each remote write request, such as
+			// X-Scope-OrgID for multi-tenant backends
+			Headers map[string]string
+			// Aggregation collapses the samples of each series within a
+			// flush into one, none, last, avg or max
+			Aggregation string
+			// Compression of remote write requests, snappy or none
+			Compression string
+			// MaxConcurrentWrites bounds the write requests in flight
+			// across all outputs and endpoints
+			MaxConcurrentWrites int
+			// ClientName identifies the remote write client in its logs and
+			// metrics, defaults to tapo
+			ClientName string
+			// Namespace is prefixed to every metric name, separated by an
+			// underscore
+			Namespace       string
+			ListenAddr      string
+			BearerToken     string
+			BearerTokenFile string
+			TLS             TLSConfig
+			// ProxyURL is the http, https or socks5 proxy remote writes are
+			// sent through, overriding the HTTP_PROXY, HTTPS_PROXY and
+			// NO_PROXY environment variables
+			ProxyURL string
+			// AdditionalEndpoints are remote written to alongside Endpoint,
+			// each with its own queue, retries and buffer
+			AdditionalEndpoints []RemoteEndpoint
+		}
+		InfluxDB struct {
+			URL    string
+			Org    string
+			Bucket string
+			Token  string
+			// TokenFile is read for the Token rather than setting it inline
+			TokenFile string
+		}
+		Pushgateway struct {
+			URL string
+			// Job is the job label pushed under, defaults to tapmon
+			Job string
+			// Grouping labels are added to each group alongside the device ip
+			Grouping map[string]string
+			Username string
+			Password string
+			// PasswordFile is read for the Password rather than setting it
+			// inline
+			PasswordFile string
+		}
+		MQTT struct {
+			// Broker is the broker URL, e.g. tcp://localhost:1883 or
+			// ssl://localhost:8883
+			Broker   string
+			ClientID string
+			Username string
+			Password string
+			// PasswordFile is read for the Password rather than setting it
+			// inline
+			PasswordFile string
+			// Topic prefixes each state topic, <Topic>/<device>/<metric>
+			Topic  string
+			QoS    int
+			Retain bool
+			// Discovery publishes Home Assistant MQTT discovery config under
+			// DiscoveryPrefix so each metric appears as a sensor
+			Discovery       bool
+			DiscoveryPrefix string
+			TLS             TLSConfig
+		}
+		VictoriaMetrics struct {
+			// URL is the base URL, e.g. http://localhost:8428, the import
+			// path being added according to Format
+			URL string
+			// Format is json for /api/v1/import or prometheus for
+			// /api/v1/import/prometheus
+			Format   string
+			Username string
+			Password string
+			// PasswordFile is read for the Password rather than setting it
+			// inline
+			PasswordFile    string
+			BearerToken     string
+			BearerTokenFile string
+			TLS             TLSConfig
+		}
+		Kafka struct {
+			// Brokers are the host:port of each bootstrap broker
+			Brokers []string
+			Topic   string
+			// Format of each message, json or protobuf
+			Format string
+			// Username and Password authenticate with SASLMechanism, plain,
+			// scram-sha-256 or scram-sha-512
+			Username string
+			Password string
+			// PasswordFile is read for the Password rather than setting it
+			// inline
+			PasswordFile  string
+			SASLMechanism string
+			EnableTLS     bool
+			TLS           TLSConfig
+		}
+		Datadog struct {
+			APIKey string
+			// APIKeyFile is read for the APIKey rather than setting it
+			// inline
+			APIKeyFile string
+			// Site is the Datadog site, defaults to datadoghq.com
+			Site string
+			// Tags are added to every series alongside a tag per label,
+			// e.g. env:home
+			Tags []string
+		}
+		Webhook struct {
+			URL      string
+			Headers  map[string]string
+			Username string
+			Password string
+			// PasswordFile is read for the Password rather than setting it
+			// inline
+			PasswordFile string
+		}
+		CSV struct {
+			Path string
+			// MaxSizeMB rotates the file once it reaches this size, keeping
+			// MaxBackups previous files, 0 disables rotation
+			MaxSizeMB  int
+			MaxBackups int
+		}
+		Debug struct {
+			// ListenAddr serves pprof and expvar diagnostics when set
+			ListenAddr string
+		}
+		Health struct {
+			// ListenAddr serves /healthz and /readyz, sharing the metrics
+			// server when equal to Prometheus.ListenAddr
+			ListenAddr string
+		}
+		// Log writes the daemon's logs to File in place of stderr when set,
+		// rotating it once it reaches MaxSize megabytes and keeping at most
+		// MaxBackups rotated files for at most MaxAge days, 0 keeping all
+		Log struct {
+			File       string
+			MaxSize    int
+			MaxAge     int
+			MaxBackups int
+			// Compress gzips rotated files
+			Compress bool
+		}
+		// dryRun logs what would be written in place of writing to the
+		// output, set by --dry-run
+		dryRun bool
+		OTLP   struct {
+			// Endpoint is the collector host:port or a URL, the
+			// /v1/metrics path is appended
+			Endpoint string
+			Headers  map[string]string
+			// Insecure uses http rather than https when Endpoint has no
+			// scheme
+			Insecure bool
+		}
+	}
+	Device struct {
+		Name     string
+		Ip       string
+		Username string
+		Password string
+		// PasswordFile is read for the Password rather than setting it inline
+		PasswordFile string
+		// Interval overrides Config.Interval for this device when set
+		Interval Seconds
+		// RequestTimeout overrides Config.RequestTimeout for this device
+		// when set
+		RequestTimeout int
+		// Group selects the device along with the others in the group in
+		// commands given --group
+		Group string
+	}
+	// Seconds is a number of seconds, configured as a bare number of seconds
+	// or a duration string such as 30s or 5m.
+	Seconds   int
+	TLSConfig struct {
+		CAFile             string
+		CertFile           string
+		KeyFile            string
+		InsecureSkipVerify bool
+		ServerName         string
+	}
+	// MetricToggles enables each group of collected metrics, all enabled by
+	// default. A device request is skipped when none of its metrics are
+	// enabled.
+	MetricToggles struct {
+		// from the energy usage request
+		Power   bool
+		Voltage bool
+		Current bool
+		// Energy covers energy_wh_total, today_energy and month_energy
+		Energy bool
+		// from the device info request
+		State bool
+		// Wifi covers wifi_rssi_dbm and wifi_signal_level
+		Wifi            bool
+		Overheated      bool
+		PowerProtection bool
+		Uptime          bool
+		Info            bool
+	}
+	// RemoteEndpoint is a further remote write endpoint with its own
+	// credentials, other Prometheus settings are shared with Endpoint.
+	RemoteEndpoint struct {
+		Endpoint        string
+		Username        string
+		Password        string
+		PasswordFile    string
+		BearerToken     string
+		BearerTokenFile string
+		// Headers replace Prometheus.Headers for this endpoint when set
+		Headers map[string]string
+	}
+)
+
+// defaultConfigFiles are tried in order when no config file is given.
+var defaultConfigFiles = []string{"tapmon.yaml", "/etc/tapmon/config.yaml"}
+
+// configFormats are the supported config file extensions, the format being
+// selected by extension.
+var configFormats = []string{"yaml", "yml", "toml", "json"}
+
+// reservedHeaders are set by the remote write client and cannot be configured
+// in Prometheus.Headers, as in Prometheus.
+var reservedHeaders = map[string]bool{
+	"authorization":                     true,
+	"host":                              true,
+	"content-encoding":                  true,
+	"content-length":                    true,
+	"content-type":                      true,
+	"user-agent":                        true,
+	"connection":                        true,
+	"keep-alive":                        true,
+	"proxy-authenticate":                true,
+	"proxy-authorization":               true,
+	"www-authenticate":                  true,
+	"accept-encoding":                   true,
+	"x-prometheus-remote-write-version": true,
+	"x-prometheus-remote-read-version":  true,
+}
+
+// energyUsage reports whether any metric from the energy usage request is
+// enabled.
+func (m MetricToggles) energyUsage() bool {
+	return m.Power || m.Voltage || m.Current || m.Energy
+}
+
+// deviceInfo reports whether any metric from the device info request is
+// enabled.
+func (m MetricToggles) deviceInfo() bool {
+	return m.State || m.Wifi || m.Overheated || m.PowerProtection || m.Uptime || m.Info
+}
+
+// configFile returns the config file given by the --config flag, else by arg,
+// else the first of defaultConfigFiles that exists.
+func configFile(cmd *cobra.Command, arg string) (string, error) {
+	if path, _ := cmd.Flags().GetString("config"); path != "" {
+		return path, nil
+	}
+	if arg != "" {
+		return arg, nil
+	}
+	for _, path := range defaultConfigFiles {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no config file given and none found at %s", strings.Join(defaultConfigFiles, ", "))
+}
+
+// loadConfig reads, unmarshals and validates the config file set on viper.
+func loadConfig() (Config, error) {
+	var conf Config
+	var err error
+
+	viper.SetDefault("Interval", 5*60)
+	viper.SetDefault("Jitter", 0.1)
+	viper.SetDefault("StaleAfter", 3)
+	viper.SetDefault("BreakerAfter", 10)
+	viper.SetDefault("ProbeInterval", 15*60)
+	viper.SetDefault("Workers", 4)
+	viper.SetDefault("ConnectConcurrency", 8)
+	viper.SetDefault("ConnectTimeout", 10)
+	viper.SetDefault("ConnectRetries", 3)
+	viper.SetDefault("ConnectRetryDelay", 5)
+	viper.SetDefault("RequestTimeout", 10)
+	viper.SetDefault("ShutdownTimeout", 30)
+	viper.SetDefault("Log.MaxSize", 100)
+	viper.SetDefault("Log.MaxBackups", 5)
+	for _, m := range []string{"Power", "Voltage", "Current", "Energy", "State", "Wifi", "Overheated", "PowerProtection", "Uptime", "Info"} {
+		viper.SetDefault("Metrics."+m, true)
+	}
+	viper.SetDefault("Output", OutputPrometheus)
+	viper.SetDefault("UserAgent", "tapmon/"+version)
+	viper.SetDefault("Pushgateway.Job", "tapmon")
+	viper.SetDefault("MQTT.ClientID", "tapmon")
+	viper.SetDefault("CSV.MaxBackups", 5)
+	viper.SetDefault("VictoriaMetrics.Format", VictoriaMetricsJSON)
+	viper.SetDefault("Datadog.Site", "datadoghq.com")
+	viper.SetDefault("Kafka.Topic", "tapmon")
+	viper.SetDefault("Kafka.Format", KafkaJSON)
+	viper.SetDefault("MQTT.Topic", "tapmon")
+	viper.SetDefault("MQTT.DiscoveryPrefix", "homeassistant")
+	viper.SetDefault("Prometheus.FlushInterval", 5*60)
+	viper.SetDefault("Prometheus.Compression", CompressionSnappy)
+	viper.SetDefault("Prometheus.ClientName", "tapo")
+	viper.SetDefault("Prometheus.MaxConcurrentWrites", 4)
+	viper.SetDefault("Prometheus.Aggregation", AggregationNone)
+	viper.SetDefault("Prometheus.QueueCapacity", 10000)
+	viper.SetDefault("Prometheus.MaxSamplesPerSend", 2000)
+	viper.SetDefault("Prometheus.MaxRetries", 3)
+	viper.SetDefault("Prometheus.BackoffInitial", 1)
+	viper.SetDefault("Prometheus.BackoffMax", 30)
+	viper.SetDefault("Prometheus.BufferRetention", 24*60*60)
+	// environment variables such as TAPMON_PROMETHEUS_PASSWORD override the
+	// config file, every setting is bound as viper only looks up those with
+	// a default or set in the file
+	viper.SetEnvPrefix("tapmon")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	for _, key := range envKeys(reflect.TypeOf(conf), "") {
+		if err = viper.BindEnv(key); err != nil {
+			return conf, err
+		}
+	}
+	if err = checkConfigFormat(viper.ConfigFileUsed()); err != nil {
+		return conf, err
+	}
+	if err = viper.ReadInConfig(); err != nil {
+		return conf, err
+	}
+	// spreading polls replaces jitter
+	if viper.GetBool("Spread") {
+		viper.SetDefault("Jitter", 0)
+	}
+	if err = viper.Unmarshal(&conf, decodeHook); err != nil {
+		return conf, err
+	}
+	conf.Devices = deviceEnv(conf.Devices)
+	if err = conf.readSecretFiles(); err != nil {
+		return conf, err
+	}
+	conf.inheritDefaults()
+	return conf, conf.validate()
+}
+
+// checkConfigFormat returns an error unless path has one of configFormats as
+// its extension.
+func checkConfigFormat(path string) error {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	for _, f := range configFormats {
+		if ext == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported config file %s, the extension must be one of %s", path, strings.Join(configFormats, ", "))
+}
+
+// readSecretFiles sets each secret configured with a *File field from the
+// contents of that file, failing if the secret is also set inline.
+func (conf *Config) readSecretFiles() error {
+	var errs []string
+
+	read := func(name string, secret *string, path string) {
+		if path == "" {
+			return
+		}
+		if *secret != "" {
+			errs = append(errs, fmt.Sprintf("only one of %s and %sFile can be configured", name, name))
+			return
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("could not read %sFile: %s", name, err))
+			return
+		}
+		*secret = strings.TrimRight(string(b), "\r\n")
+	}
+	read("Prometheus.Password", &conf.Prometheus.Password, conf.Prometheus.PasswordFile)
+	read("InfluxDB.Token", &conf.InfluxDB.Token, conf.InfluxDB.TokenFile)
+	read("Defaults.Password", &conf.Defaults.Password, conf.Defaults.PasswordFile)
+	read("Pushgateway.Password", &conf.Pushgateway.Password, conf.Pushgateway.PasswordFile)
+	read("MQTT.Password", &conf.MQTT.Password, conf.MQTT.PasswordFile)
+	read("Webhook.Password", &conf.Webhook.Password, conf.Webhook.PasswordFile)
+	read("VictoriaMetrics.Password", &conf.VictoriaMetrics.Password, conf.VictoriaMetrics.PasswordFile)
+	read("Datadog.APIKey", &conf.Datadog.APIKey, conf.Datadog.APIKeyFile)
+	read("Kafka.Password", &conf.Kafka.Password, conf.Kafka.PasswordFile)
+	for i := range conf.Prometheus.AdditionalEndpoints {
+		e := &conf.Prometheus.AdditionalEndpoints[i]
+		read(fmt.Sprintf("Prometheus.AdditionalEndpoints[%d].Password", i), &e.Password, e.PasswordFile)
+	}
+	for i := range conf.Devices {
+		read(fmt.Sprintf("Devices[%d].Password", i), &conf.Devices[i].Password, conf.Devices[i].PasswordFile)
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// inheritDefaults sets the Username and Password of each device that does not
+// configure them to those in Defaults.
+func (conf *Config) inheritDefaults() {
+	for i := range conf.Devices {
+		d := &conf.Devices[i]
+		if d.Username == "" {
+			d.Username = conf.Defaults.Username
+		}
+		if d.Password == "" {
+			d.Password = conf.Defaults.Password
+		}
+	}
+}
+
+// envKeys returns the keys of the settings of t, a struct, that can be set
+// by an environment variable, prefixed with prefix. Lists other than of
+// strings and maps cannot, Devices being set by deviceEnv.
+func envKeys(t reflect.Type, prefix string) []string {
+	var keys []string
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := prefix + f.Name
+		switch {
+		case !f.IsExported():
+		case f.Type.Kind() == reflect.Struct:
+			keys = append(keys, envKeys(f.Type, key+".")...)
+		case f.Type.Kind() == reflect.Map, f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() != reflect.String:
+			// not representable as a single value
+		default:
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// deviceEnv overrides the credentials of each device with the
+// TAPMON_DEVICES_<index>_USERNAME and TAPMON_DEVICES_<index>_PASSWORD
+// environment variables when set, devices being indexed from 0 in config
+// file order.
+func deviceEnv(devices []Device) []Device {
+	for i := range devices {
+		if v, ok := os.LookupEnv(fmt.Sprintf("TAPMON_DEVICES_%d_USERNAME", i)); ok {
+			devices[i].Username = v
+		}
+		if v, ok := os.LookupEnv(fmt.Sprintf("TAPMON_DEVICES_%d_PASSWORD", i)); ok {
+			devices[i].Password = v
+		}
+	}
+	return devices
+}
+
+// validate checks conf for values that would otherwise fail at runtime,
+// returning all the problems found as a single error.
+func (conf Config) validate() error {
+	var errs []string
+	var err error
+
+	if conf.Interval <= 0 {
+		errs = append(errs, "Interval must be greater than 0")
+	}
+	if conf.Jitter < 0 || conf.Jitter >= 1 {
+		errs = append(errs, "Jitter must be at least 0 and less than 1")
+	}
+	if conf.Spread && conf.Jitter != 0 {
+		errs = append(errs, "Jitter must be 0 when Spread is enabled")
+	}
+	if conf.Workers <= 0 {
+		errs = append(errs, "Workers must be greater than 0")
+	}
+	if conf.ConnectConcurrency <= 0 || conf.ConnectTimeout <= 0 {
+		errs = append(errs, "ConnectConcurrency and ConnectTimeout must be greater than 0")
+	}
+	if conf.ConnectRetries < 0 || conf.ConnectRetryDelay < 0 {
+		errs = append(errs, "ConnectRetries and ConnectRetryDelay must not be negative")
+	}
+	if conf.RequestTimeout <= 0 {
+		errs = append(errs, "RequestTimeout must be greater than 0")
+	}
+	if conf.ShutdownTimeout <= 0 {
+		errs = append(errs, "ShutdownTimeout must be greater than 0")
+	}
+	if conf.Log.File != "" {
+		if conf.Log.MaxSize <= 0 {
+			errs = append(errs, "Log.MaxSize must be greater than 0")
+		}
+		if conf.Log.MaxAge < 0 || conf.Log.MaxBackups < 0 {
+			errs = append(errs, "Log.MaxAge and Log.MaxBackups must not be negative")
+		}
+	}
+	if conf.StaleAfter < 0 {
+		errs = append(errs, "StaleAfter must not be negative")
+	}
+	if conf.BreakerAfter < 0 {
+		errs = append(errs, "BreakerAfter must not be negative")
+	}
+	if conf.ProbeInterval <= 0 {
+		errs = append(errs, "ProbeInterval must be greater than 0")
+	}
+	if !conf.Metrics.energyUsage() && !conf.Metrics.deviceInfo() {
+		errs = append(errs, "at least one of Metrics must be enabled")
+	}
+	if ns := conf.Prometheus.Namespace; ns != "" && !model.IsValidMetricName(model.LabelValue(ns)) {
+		errs = append(errs, fmt.Sprintf("invalid Prometheus.Namespace %s", ns))
+	}
+	switch conf.Output {
+	case OutputPrometheus:
+		if conf.Prometheus.Endpoint == "" && conf.Prometheus.ListenAddr == "" {
+			errs = append(errs, "one of Prometheus.Endpoint or Prometheus.ListenAddr must be configured")
+		}
+		if conf.Prometheus.Endpoint != "" {
+			if err = checkHTTPURL(conf.Prometheus.Endpoint); err != nil {
+				errs = append(errs, fmt.Sprintf("invalid Prometheus.Endpoint: %s", err))
+			}
+			if _, err = httpClientConfig(conf); err != nil {
+				errs = append(errs, fmt.Sprintf("invalid Prometheus config: %s", err))
+			}
+			for name := range conf.Prometheus.ExternalLabels {
+				if !model.LabelName(name).IsValid() {
+					errs = append(errs, fmt.Sprintf("invalid Prometheus.ExternalLabels name %s", name))
+				}
+			}
+			if _, err = writeRelabelConfigs(conf); err != nil {
+				errs = append(errs, fmt.Sprintf("invalid Prometheus.WriteRelabelConfigs: %s", err))
+			}
+			errs = append(errs, headerErrors("Prometheus.Headers", conf.Prometheus.Headers)...)
+			if c := conf.Prometheus.Compression; c != CompressionSnappy && c != CompressionNone {
+				errs = append(errs, fmt.Sprintf("unknown Prometheus.Compression %s", c))
+			}
+			if strings.TrimSpace(conf.Prometheus.ClientName) == "" {
+				errs = append(errs, "Prometheus.ClientName must not be empty")
+			}
+		} else if len(conf.Prometheus.AdditionalEndpoints) > 0 {
+			errs = append(errs, "Prometheus.AdditionalEndpoints requires Prometheus.Endpoint")
+		}
+		for i, e := range conf.Prometheus.AdditionalEndpoints {
+			if e.Endpoint == "" {
+				errs = append(errs, fmt.Sprintf("Prometheus.AdditionalEndpoints[%d] has no Endpoint", i))
+			} else if err = checkHTTPURL(e.Endpoint); err != nil {
+				errs = append(errs, fmt.Sprintf("invalid Prometheus.AdditionalEndpoints[%d].Endpoint: %s", i, err))
+			}
+			if _, err = httpClientConfig(conf.withEndpoint(e)); err != nil {
+				errs = append(errs, fmt.Sprintf("invalid Prometheus.AdditionalEndpoints[%d] config: %s", i, err))
+			}
+			errs = append(errs, headerErrors(fmt.Sprintf("Prometheus.AdditionalEndpoints[%d].Headers", i), e.Headers)...)
+		}
+	case OutputInfluxDB:
+		if conf.InfluxDB.URL == "" {
+			errs = append(errs, "InfluxDB.URL must be configured")
+		} else if err = checkHTTPURL(conf.InfluxDB.URL); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid InfluxDB.URL: %s", err))
+		}
+		if conf.InfluxDB.Org == "" || conf.InfluxDB.Bucket == "" {
+			errs = append(errs, "InfluxDB.Org and InfluxDB.Bucket must be configured")
+		}
+	case OutputOTLP:
+		if conf.OTLP.Endpoint == "" {
+			errs = append(errs, "OTLP.Endpoint must be configured")
+		}
+	case OutputPushgateway:
+		if conf.Pushgateway.URL == "" {
+			errs = append(errs, "Pushgateway.URL must be configured")
+		} else if err = checkHTTPURL(conf.Pushgateway.URL); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid Pushgateway.URL: %s", err))
+		}
+		if conf.Pushgateway.Job == "" {
+			errs = append(errs, "Pushgateway.Job must not be empty")
+		}
+		for name := range conf.Pushgateway.Grouping {
+			if !model.LabelName(name).IsValid() || name == "ip" {
+				errs = append(errs, fmt.Sprintf("invalid Pushgateway.Grouping name %s", name))
+			}
+		}
+	case OutputMQTT:
+		if conf.MQTT.Broker == "" {
+			errs = append(errs, "MQTT.Broker must be configured")
+		} else if _, err = url.Parse(conf.MQTT.Broker); err != nil {
+			errs = append(errs, fmt.Sprintf("could not parse MQTT.Broker: %s", err))
+		}
+		if conf.MQTT.Topic == "" || strings.ContainsAny(conf.MQTT.Topic, "+#") {
+			errs = append(errs, "MQTT.Topic must not be empty or contain wildcards")
+		}
+		if conf.MQTT.QoS < 0 || conf.MQTT.QoS > 2 {
+			errs = append(errs, "MQTT.QoS must be 0, 1 or 2")
+		}
+		if conf.MQTT.Discovery && (conf.MQTT.DiscoveryPrefix == "" || strings.ContainsAny(conf.MQTT.DiscoveryPrefix, "+#")) {
+			errs = append(errs, "MQTT.DiscoveryPrefix must not be empty or contain wildcards")
+		}
+		if (conf.MQTT.TLS.CertFile == "") != (conf.MQTT.TLS.KeyFile == "") {
+			errs = append(errs, "MQTT.TLS CertFile and KeyFile must be configured together")
+		}
+	case OutputVictoriaMetrics:
+		v := conf.VictoriaMetrics
+		if v.URL == "" {
+			errs = append(errs, "VictoriaMetrics.URL must be configured")
+		} else if err = checkHTTPURL(v.URL); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid VictoriaMetrics.URL: %s", err))
+		}
+		if v.Format != VictoriaMetricsJSON && v.Format != VictoriaMetricsPrometheus {
+			errs = append(errs, fmt.Sprintf("unknown VictoriaMetrics.Format %s", v.Format))
+		}
+		if _, err = newHTTPClientConfig(v.Username, v.Password, v.BearerToken, v.BearerTokenFile, v.TLS); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid VictoriaMetrics config: %s", err))
+		}
+	case OutputKafka:
+		k := conf.Kafka
+		if len(k.Brokers) == 0 || k.Topic == "" {
+			errs = append(errs, "Kafka.Brokers and Kafka.Topic must be configured")
+		}
+		if k.Format != KafkaJSON && k.Format != KafkaProtobuf {
+			errs = append(errs, fmt.Sprintf("unknown Kafka.Format %s", k.Format))
+		}
+		if _, err = kafkaSASL(k.SASLMechanism, k.Username, k.Password); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid Kafka config: %s", err))
+		}
+		if (k.TLS.CertFile == "") != (k.TLS.KeyFile == "") {
+			errs = append(errs, "Kafka.TLS CertFile and KeyFile must be configured together")
+		}
+	case OutputDatadog:
+		if conf.Datadog.APIKey == "" {
+			errs = append(errs, "Datadog.APIKey must be configured")
+		}
+		if conf.Datadog.Site == "" || strings.ContainsAny(conf.Datadog.Site, "/:") {
+			errs = append(errs, fmt.Sprintf("invalid Datadog.Site %s, expected e.g. datadoghq.eu", conf.Datadog.Site))
+		}
+	case OutputWebhook:
+		if conf.Webhook.URL == "" {
+			errs = append(errs, "Webhook.URL must be configured")
+		} else if err = checkHTTPURL(conf.Webhook.URL); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid Webhook.URL: %s", err))
+		}
+	case OutputCSV:
+		if conf.CSV.Path == "" {
+			errs = append(errs, "CSV.Path must be configured")
+		}
+		if conf.CSV.MaxSizeMB < 0 || conf.CSV.MaxBackups < 0 {
+			errs = append(errs, "CSV.MaxSizeMB and CSV.MaxBackups must not be negative")
+		}
+	case OutputStdout:
+	default:
+		errs = append(errs, fmt.Sprintf("unknown Output %s", conf.Output))
+	}
+	if conf.push() {
+		if conf.Prometheus.FlushInterval <= 0 {
+			errs = append(errs, "Prometheus.FlushInterval must be greater than 0")
+		}
+		if conf.Prometheus.QueueCapacity <= 0 {
+			errs = append(errs, "Prometheus.QueueCapacity must be greater than 0")
+		}
+		if conf.Prometheus.MaxSamplesPerSend <= 0 {
+			errs = append(errs, "Prometheus.MaxSamplesPerSend must be greater than 0")
+		}
+		if conf.Prometheus.MaxConcurrentWrites <= 0 {
+			errs = append(errs, "Prometheus.MaxConcurrentWrites must be greater than 0")
+		}
+		if conf.Prometheus.MaxRetries < 0 {
+			errs = append(errs, "Prometheus.MaxRetries must not be negative")
+		}
+		if conf.Prometheus.BackoffInitial <= 0 || conf.Prometheus.BackoffMax < conf.Prometheus.BackoffInitial {
+			errs = append(errs, "Prometheus.BackoffInitial must be greater than 0 and no more than Prometheus.BackoffMax")
+		}
+		switch conf.Prometheus.Aggregation {
+		case AggregationNone, AggregationLast, AggregationAvg, AggregationMax:
+		default:
+			errs = append(errs, fmt.Sprintf("unknown Prometheus.Aggregation %s", conf.Prometheus.Aggregation))
+		}
+		if conf.Prometheus.BufferRetention < 0 {
+			errs = append(errs, "Prometheus.BufferRetention must not be negative")
+		}
+		if conf.Prometheus.MaxSampleAge < 0 {
+			errs = append(errs, "Prometheus.MaxSampleAge must not be negative")
+		}
+	}
+	if len(conf.Devices) == 0 {
+		errs = append(errs, "no Devices configured")
+	}
+	ips := make(map[string]int)
+	names := make(map[string]int)
+	for i, d := range conf.Devices {
+		if j, ok := ips[d.Ip]; ok && d.Ip != "" {
+			errs = append(errs, fmt.Sprintf("Devices[%d] has the same Ip %s as Devices[%d]", i, d.Ip, j))
+		} else {
+			ips[d.Ip] = i
+		}
+		if j, ok := names[d.Name]; ok && d.Name != "" {
+			errs = append(errs, fmt.Sprintf("Devices[%d] has the same Name %s as Devices[%d]", i, d.Name, j))
+		} else {
+			names[d.Name] = i
+		}
+		if d.Ip == "" {
+			errs = append(errs, fmt.Sprintf("Devices[%d] has no Ip", i))
+		}
+		if d.Username == "" || d.Password == "" {
+			errs = append(errs, fmt.Sprintf("Devices[%d] must have a Username and Password, set on the device or in Defaults", i))
+		}
+		if d.Interval < 0 {
+			errs = append(errs, fmt.Sprintf("Devices[%d] Interval must not be negative", i))
+		}
+		if d.RequestTimeout < 0 {
+			errs = append(errs, fmt.Sprintf("Devices[%d] RequestTimeout must not be negative", i))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// decodeHook decodes Seconds from duration strings along with viper's
+// default conversions.
+var decodeHook = viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+	secondsHook,
+	mapstructure.StringToTimeDurationHookFunc(),
+	mapstructure.StringToSliceHookFunc(","),
+))
+
+// secondsHook decodes a string into Seconds as a bare number of seconds or a
+// duration string of whole seconds.
+func secondsHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String || to != reflect.TypeOf(Seconds(0)) {
+		return data, nil
+	}
+	s := strings.TrimSpace(data.(string))
+	if n, err := strconv.Atoi(s); err == nil {
+		return Seconds(n), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid duration %q, want seconds or a duration such as 30s or 5m", s)
+	}
+	if d%time.Second != 0 {
+		return nil, fmt.Errorf("invalid duration %q, must be whole seconds", s)
+	}
+	return Seconds(d / time.Second), nil
+}
+
+// Duration returns s as a time.Duration.
+func (s Seconds) Duration() time.Duration {
+	return time.Duration(s) * time.Second
+}
+
+// checkHTTPURL returns an error unless u is an http or https URL with a host.
+func checkHTTPURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("%s must use the http or https scheme", u)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("%s has no host", u)
+	}
+	return nil
+}
+
+// headerErrors returns a problem for each of headers that is reserved, field
+// naming the config setting they are from.
+func headerErrors(field string, headers map[string]string) []string {
+	var errs []string
+	for name := range headers {
+		if reservedHeaders[strings.ToLower(name)] {
+			errs = append(errs, fmt.Sprintf("%s cannot set reserved header %s", field, name))
+		}
+	}
+	sort.Strings(errs)
+	return errs
+}
+
+// push reports whether collected time-series are pushed to an output backend
+// rather than only being exposed in pull mode.
+func (conf Config) push() bool {
+	return conf.Output != OutputPrometheus || conf.Prometheus.Endpoint != ""
+}
+
+// outputs returns the config for each WriteMetrics, one per remote write
+// endpoint when pushing to Prometheus. Additional endpoints buffer to
+// BufferPath suffixed with their position in the list, counting from 1.
+func (conf Config) outputs() []Config {
+	outs := []Config{conf}
+	if conf.Output != OutputPrometheus {
+		return outs
+	}
+	for i, e := range conf.Prometheus.AdditionalEndpoints {
+		c := conf.withEndpoint(e)
+		if c.Prometheus.BufferPath != "" {
+			c.Prometheus.BufferPath = fmt.Sprintf("%s.%d", c.Prometheus.BufferPath, i+1)
+		}
+		outs = append(outs, c)
+	}
+	return outs
+}
+
+// withEndpoint returns conf remote writing to e in place of
+// Prometheus.Endpoint.
+func (conf Config) withEndpoint(e RemoteEndpoint) Config {
+	p := &conf.Prometheus
+	p.Endpoint, p.Username, p.Password, p.PasswordFile = e.Endpoint, e.Username, e.Password, e.PasswordFile
+	p.BearerToken, p.BearerTokenFile = e.BearerToken, e.BearerTokenFile
+	if len(e.Headers) > 0 {
+		p.Headers = e.Headers
+	}
+	p.AdditionalEndpoints = nil
+	return conf
+}
+
+// outputString describes the output conf pushes to.
+func outputString(conf Config) string {
+	if conf.Output == OutputPrometheus {
+		return fmt.Sprintf("%s %s", conf.Output, conf.Prometheus.Endpoint)
+	}
+	return conf.Output
+}
+
+// effectiveInterval returns the poll interval in seconds for d, falling back
+// to def when the device does not override it.
+func (d Device) effectiveInterval(def int) int {
+	if d.Interval > 0 {
+		return int(d.Interval)
+	}
+	return def
+}
+
+// effectiveRequestTimeout returns the timeout for each request to d, falling
+// back to requestTimeout when the device does not override it.
+func (d Device) effectiveRequestTimeout() time.Duration {
+	if d.RequestTimeout > 0 {
+		return time.Duration(d.RequestTimeout) * time.Second
+	}
+	return time.Duration(requestTimeout.Load())
+}
+
+// writeRelabelConfigs parses Prometheus.WriteRelabelConfigs, which use the
+// same format as in the Prometheus config file.
+func writeRelabelConfigs(conf Config) ([]*relabel.Config, error) {
+	var cfgs []*relabel.Config
+
+	if len(conf.Prometheus.WriteRelabelConfigs) == 0 {
+		return nil, nil
+	}
+	b, err := yaml.Marshal(conf.Prometheus.WriteRelabelConfigs)
+	if err != nil {
+		return nil, err
+	}
+	return cfgs, yaml.UnmarshalStrict(b, &cfgs)
+}
+
+// httpClientConfig returns the remote write HTTP client config for conf,
+// using either basic auth or a bearer token and any proxy.
+func httpClientConfig(conf Config) (config.HTTPClientConfig, error) {
+	p := conf.Prometheus
+	c, err := newHTTPClientConfig(p.Username, p.Password, p.BearerToken, p.BearerTokenFile, p.TLS)
+	if err != nil {
+		return c, err
+	}
+	proxy, err := proxyURL(p.ProxyURL, p.Endpoint)
+	if err != nil {
+		return c, fmt.Errorf("invalid ProxyURL: %w", err)
+	}
+	c.ProxyURL = config.URL{URL: proxy}
+	return c, c.Validate()
+}
+
+// proxyURL returns the proxy to reach endpoint through, proxy when set and
+// otherwise taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables, or nil for none.
+func proxyURL(proxy string, endpoint string) (*url.URL, error) {
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+			return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		}
+		return u, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return http.ProxyFromEnvironment(&http.Request{URL: u})
+}
+
+// newHTTPClientConfig returns an HTTP client config authenticating with basic
+// auth or a bearer token, of which at most one may be configured, over tls.
+func newHTTPClientConfig(username, password, bearerToken, bearerTokenFile string, tls TLSConfig) (config.HTTPClientConfig, error) {
+	var c config.HTTPClientConfig
+
+	basic := username != "" || password != ""
+	bearer := bearerToken != "" || bearerTokenFile != ""
+	if basic && bearer {
+		return c, errors.New("basic auth and bearer token cannot both be configured")
+	}
+	if basic {
+		c.BasicAuth = &config.BasicAuth{
+			Username: username,
+			Password: config.Secret(password),
+		}
+	}
+	if bearer {
+		c.Authorization = &config.Authorization{
+			Type:            "Bearer",
+			Credentials:     config.Secret(bearerToken),
+			CredentialsFile: bearerTokenFile,
+		}
+	}
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		return c, errors.New("TLS CertFile and KeyFile must be configured together")
+	}
+	c.TLSConfig = config.TLSConfig{
+		CAFile:             tls.CAFile,
+		CertFile:           tls.CertFile,
+		KeyFile:            tls.KeyFile,
+		ServerName:         tls.ServerName,
+		InsecureSkipVerify: tls.InsecureSkipVerify,
+	}
+	return c, c.Validate()
+}
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv("TAPMON_INTERVAL", "30")
+	t.Setenv("TAPMON_PROMETHEUS_NAMESPACE", "home")
+	t.Setenv("TAPMON_PROMETHEUS_TLS_INSECURESKIPVERIFY", "true")
+	t.Setenv("TAPMON_KAFKA_BROKERS", "kafka1:9092,kafka2:9092")
+	t.Setenv("TAPMON_DEVICES_0_PASSWORD", "secret")
+
+	conf := loadTestConfig(t, "tapmon.yaml", `
+Interval: 60
+Devices:
+  - Ip: 192.168.1.2
+    Username: user
+    Password: file
+Prometheus:
+  Endpoint: http://localhost:9090/api/v1/write
+`)
+	if conf.Interval != 30 {
+		t.Errorf("got Interval %d, want 30", conf.Interval)
+	}
+	if conf.Prometheus.Namespace != "home" {
+		t.Errorf("got Prometheus.Namespace %q, want home", conf.Prometheus.Namespace)
+	}
+	if !conf.Prometheus.TLS.InsecureSkipVerify {
+		t.Error("got Prometheus.TLS.InsecureSkipVerify false, want true")
+	}
+	if want := []string{"kafka1:9092", "kafka2:9092"}; !reflect.DeepEqual(conf.Kafka.Brokers, want) {
+		t.Errorf("got Kafka.Brokers %v, want %v", conf.Kafka.Brokers, want)
+	}
+	if conf.Devices[0].Password != "secret" {
+		t.Errorf("got device password %q, want secret", conf.Devices[0].Password)
+	}
+}
+
+func TestReadSecretFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var conf Config
+	conf.Pushgateway.PasswordFile = path
+	if err := conf.readSecretFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Pushgateway.Password != "secret" {
+		t.Errorf("got Pushgateway.Password %q, want secret", conf.Pushgateway.Password)
+	}
+
+	conf.Pushgateway.Password = "inline"
+	if err := conf.readSecretFiles(); err == nil || !strings.Contains(err.Error(), "Pushgateway.PasswordFile") {
+		t.Errorf("got error %v setting both Pushgateway.Password and Pushgateway.PasswordFile", err)
+	}
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	configs := map[string]string{
+		"tapmon.yaml": `
+interval: 1m
+jitter: 0.2
+devices:
+  - ip: 192.168.1.2
+    name: fridge
+    username: user
+    password: secret
+    interval: 30s
+prometheus:
+  endpoint: http://localhost:9090/api/v1/write
+  flushInterval: 2m
+  headers:
+    x-tenant: home
+  externalLabels:
+    site: home
+  additionalEndpoints:
+    - endpoint: http://backup:9090/api/v1/write
+      username: backup
+      password: pass
+`,
+		"tapmon.json": `{
+  "interval": "1m",
+  "jitter": 0.2,
+  "devices": [
+    {"ip": "192.168.1.2", "name": "fridge", "username": "user", "password": "secret", "interval": "30s"}
+  ],
+  "prometheus": {
+    "endpoint": "http://localhost:9090/api/v1/write",
+    "flushInterval": "2m",
+    "headers": {"x-tenant": "home"},
+    "externalLabels": {"site": "home"},
+    "additionalEndpoints": [
+      {"endpoint": "http://backup:9090/api/v1/write", "username": "backup", "password": "pass"}
+    ]
+  }
+}`,
+		"tapmon.toml": `
+interval = "1m"
+jitter = 0.2
+
+[[devices]]
+ip = "192.168.1.2"
+name = "fridge"
+username = "user"
+password = "secret"
+interval = "30s"
+
+[prometheus]
+endpoint = "http://localhost:9090/api/v1/write"
+flushInterval = "2m"
+
+[prometheus.headers]
+x-tenant = "home"
+
+[prometheus.externalLabels]
+site = "home"
+
+[[prometheus.additionalEndpoints]]
+endpoint = "http://backup:9090/api/v1/write"
+username = "backup"
+password = "pass"
+`,
+	}
+
+	want := loadTestConfig(t, "tapmon.yaml", configs["tapmon.yaml"])
+	if want.Interval != 60 || want.Devices[0].Interval != 30 || want.Prometheus.FlushInterval != 120 {
+		t.Errorf("got intervals %d, %d and %d, want 60, 30 and 120", want.Interval, want.Devices[0].Interval, want.Prometheus.FlushInterval)
+	}
+	if len(want.Prometheus.AdditionalEndpoints) != 1 || want.Prometheus.AdditionalEndpoints[0].Username != "backup" {
+		t.Errorf("got additional endpoints %+v", want.Prometheus.AdditionalEndpoints)
+	}
+	for _, name := range []string{"tapmon.json", "tapmon.toml"} {
+		t.Run(name, func(t *testing.T) {
+			if got := loadTestConfig(t, name, configs[name]); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestValidateDeviceOverrides(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		d    Device
+		want string
+	}{
+		{name: "inherited", d: Device{}},
+		{name: "negative interval", d: Device{Interval: -1}, want: "Devices[0] Interval must not be negative"},
+		{name: "negative request timeout", d: Device{RequestTimeout: -1}, want: "Devices[0] RequestTimeout must not be negative"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := loadTestConfig(t, "tapmon.yaml", `
+Devices:
+  - Ip: 192.168.1.2
+    Username: user
+    Password: secret
+Prometheus:
+  Endpoint: http://localhost:9090/api/v1/write
+`)
+			tc.d.Ip, tc.d.Username, tc.d.Password = "192.168.1.2", "user", "secret"
+			conf.Devices[0] = tc.d
+			err := conf.validate()
+			if tc.want == "" && err != nil {
+				t.Errorf("got error %v, want none", err)
+			}
+			if tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+				t.Errorf("got error %v, want %s", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"io/fs"
+	"os"
+	"strconv"
+)
+
+// csvHeader is the first row of each CSV file.
+var csvHeader = []string{"timestamp", "ip", "name", "channel", "metric", "value"}
+
+type (
+	// csvWriter is a Writer appending a row per sample to a CSV file,
+	// rotating it once it reaches maxSize bytes.
+	csvWriter struct {
+		path    string
+		maxSize int64
+		backups int
+	}
+)
+
+func newCSVWriter(conf Config) (*csvWriter, error) {
+	return &csvWriter{
+		path:    conf.CSV.Path,
+		maxSize: int64(conf.CSV.MaxSizeMB) * 1024 * 1024,
+		backups: conf.CSV.MaxBackups,
+	}, nil
+}
+
+// Write appends a row for each sample in tss, writing the header first when
+// the file is created.
+func (w *csvWriter) Write(_ context.Context, tss []prompb.TimeSeries) error {
+	var f *os.File
+	var info fs.FileInfo
+	var err error
+
+	if err = w.rotate(); err != nil {
+		return fmt.Errorf("could not rotate %s: %w", w.path, err)
+	}
+	if f, err = os.OpenFile(w.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err = f.Stat(); err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(f)
+	if info.Size() == 0 {
+		_ = cw.Write(csvHeader)
+	}
+	for _, s := range samples(tss) {
+		_ = cw.Write([]string{s.Timestamp, s.Ip, s.Name, s.Channel, s.Metric, strconv.FormatFloat(s.Value, 'f', -1, 64)})
+	}
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// rotate renames the file to <path>.1, shifting existing backups up and
+// removing the oldest, once it has reached maxSize. Rotation is disabled
+// when maxSize is 0.
+func (w *csvWriter) rotate() error {
+	if w.maxSize <= 0 {
+		return nil
+	}
+	info, err := os.Stat(w.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil || info.Size() < w.maxSize {
+		return err
+	}
+	for i := w.backups - 1; i > 0; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if w.backups == 0 {
+		return os.Remove(w.path)
+	}
+	return os.Rename(w.path, w.path+".1")
+}
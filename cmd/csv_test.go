@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"context"
+	"github.com/prometheus/prometheus/prompb"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCSVWrite(t *testing.T) {
+	conf := Config{}
+	conf.CSV.Path = filepath.Join(t.TempDir(), "readings.csv")
+	w, err := newCSVWriter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := client{d: Device{Ip: "192.168.1.2", Name: "meter"}}
+	tss := []prompb.TimeSeries{
+		c.timeSeries(currentPowerMetric, 12345, 1669888800000, prompb.Label{Name: "channel", Value: "1"}),
+		c.timeSeries(upMetric, 1, 1669888800000),
+	}
+	if err = w.Write(context.Background(), tss); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(conf.CSV.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "timestamp,ip,name,channel,metric,value\n" +
+		"2022-12-01T10:00:00Z,192.168.1.2,meter,1,current_power,12345\n" +
+		"2022-12-01T10:00:00Z,192.168.1.2,meter,,up,1\n"
+	if string(b) != want {
+		t.Errorf("got\n%s\nwant\n%s", b, want)
+	}
+}
@@ -1,45 +1,27 @@
 package cmd
 
 import (
-	"context"
+	"errors"
 	"fmt"
-	"github.com/golang/protobuf/proto"
-	"github.com/golang/snappy"
-	"github.com/prometheus/common/config"
-	"github.com/prometheus/common/model"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/prompb"
-	"github.com/prometheus/prometheus/storage/remote"
-	"github.com/richardjennings/tapo/pkg/tapo"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"net/url"
+	"gopkg.in/natefinch/lumberjack.v2"
 	"os"
+	"os/signal"
+	"reflect"
 	"sync"
+	"syscall"
 	"time"
 )
 
-type (
-	Config struct {
-		Interval   int
-		Devices    []Device
-		Prometheus struct {
-			Endpoint      string
-			Username      string
-			Password      string
-			FlushInterval int
-		}
-	}
-	Device struct {
-		Ip       string
-		Username string
-		Password string
-	}
-	client struct {
-		t *tapo.Tapo
-		d Device
-	}
-)
+// shutdownGrace is allowed beyond ShutdownTimeout for goroutines to log and
+// return after the final flush gives up.
+const shutdownGrace = time.Second
+
+var stopOnce sync.Once
 
 func init() {
 	var l log.Level
@@ -53,181 +35,227 @@ func init() {
 		}
 	}
 	log.SetLevel(l)
+
+	switch f := os.Getenv("TAPMON_LOGFORMAT"); f {
+	case "", "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.Warningf("unknown log format %s, using text", f)
+	}
 }
 
 var daemonCmd = &cobra.Command{
-	Args: cobra.ExactArgs(1),
+	Use:               "tapmon [config]",
+	Short:             "Monitor Tapo smart plug energy usage",
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: completeConfig,
+	// errors are printed by Execute
+	SilenceErrors: true,
+	SilenceUsage:  true,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		var cs []client
 		var conf Config
-		var t *tapo.Tapo
+		var path string
+		var c client
+		var clients []client
 		var err error
+		var stopErr error
 
-		viper.SetConfigFile(args[0])
-		viper.SetDefault("Interval", 5*60)
-		viper.SetDefault("Prometheus.FlushInterval", 5*60)
-		cobra.CheckErr(viper.ReadInConfig())
-		cobra.CheckErr(viper.Unmarshal(&conf))
-
-		if len(conf.Devices) == 0 {
-			cobra.CheckErr("no Devices configured")
+		if stdout, _ := cmd.Flags().GetBool("stdout"); stdout {
+			viper.Set("Output", OutputStdout)
 		}
-
-		for _, d := range conf.Devices {
-			// check we can communicate with Device
-			t, err = tapo.NewTapo(d.Ip, d.Username, d.Password)
-			if err != nil {
-				cobra.CheckErr(fmt.Sprintf("could not connect to Device with ip %s", d.Ip))
+		once, _ := cmd.Flags().GetBool("once")
+		path, err = configFile(cmd, firstArg(args))
+		cobra.CheckErr(err)
+		viper.SetConfigFile(path)
+		conf, err = loadConfig()
+		cobra.CheckErr(err)
+		if conf.Log.File != "" {
+			l := &lumberjack.Logger{
+				Filename:   conf.Log.File,
+				MaxSize:    conf.Log.MaxSize,
+				MaxAge:     conf.Log.MaxAge,
+				MaxBackups: conf.Log.MaxBackups,
+				Compress:   conf.Log.Compress,
 			}
-			cs = append(cs, client{t: t, d: d})
-			log.Infof("connected to device %s", d.Ip)
+			defer l.Close()
+			log.SetOutput(l)
+		}
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		conf = withDryRun(conf, dryRun)
+		metricNamespace = conf.Prometheus.Namespace
+		setCollection(conf)
+		writeSlots = make(chan struct{}, conf.Prometheus.MaxConcurrentWrites)
+		if once && !conf.push() {
+			cobra.CheckErr("--once requires an output to push to")
 		}
 
 		stop := make(chan bool)
-		metrics := make(chan prompb.TimeSeries)
+		var metrics queues
+		// reloads passes each output's config to its WriteMetrics on reload
+		var reloads []chan Config
+		var gauges *gaugeSet
+		if conf.push() {
+			for range conf.outputs() {
+				metrics = append(metrics, make(chan prompb.TimeSeries, conf.Prometheus.QueueCapacity))
+			}
+			registerQueueLength(metrics)
+			metrics.enqueue(buildInfoSeries(time.Now()))
+		}
+		if conf.Prometheus.ListenAddr != "" && !once {
+			gauges = newGaugeSet(prometheus.DefaultRegisterer)
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		defer signal.Stop(sigs)
+
+		if conf.CheckOutput && conf.push() && !conf.dryRun {
+			for _, out := range conf.outputs() {
+				if out.Output == OutputStdout {
+					continue
+				}
+				if err = checkOutput(out); err != nil {
+					cobra.CheckErr(fmt.Errorf("could not write to %s output: %w", outputString(out), err))
+				}
+				log.Infof("checked %s output", outputString(out))
+			}
+		}
 
 		wg := sync.WaitGroup{}
+		clk := realClock{}
+		cs := newCollectors(&wg, clk, newCollectOptions(conf), conf.Devices, conf.Workers, metrics, gauges)
 
-		for _, c := range cs {
+		// check we can communicate with each Device, skipping those we cannot
+		// so that one unreachable device does not stop monitoring of the
+		// others
+		clients = connectAll(conf.Devices, conf.ConnectConcurrency, time.Duration(conf.ConnectTimeout)*time.Second, conf.ConnectRetries, time.Duration(conf.ConnectRetryDelay)*time.Second)
+		if len(clients) == 0 {
+			cobra.CheckErr("could not connect to any Devices")
+		}
+		if !once {
+			cs.run(stop)
+			for _, c = range clients {
+				cs.start(c)
+			}
+		}
+		if metrics != nil {
+			readiness.pendingWriters.Store(int64(len(metrics)))
+			for i, out := range conf.outputs() {
+				log.Infof("starting WriteMetrics to %s", outputString(out))
+				reloads = append(reloads, make(chan Config, 1))
+				wg.Add(1)
+				go WriteMetrics(&wg, stop, clk, metrics[i], reloads[i], out)
+			}
+		}
+		// health endpoints share the metrics server when on the same address
+		health := conf.Health.ListenAddr != "" && !once
+		if gauges != nil {
+			log.Info("starting ServeMetrics")
 			wg.Add(1)
-			log.Infof("starting CollectEnergyUsage for %s", c.d.Ip)
-			go CollectEnergyUsage(&wg, stop, conf.Interval, c, metrics)
+			go ServeMetrics(&wg, stop, conf.Prometheus.ListenAddr, health && conf.Health.ListenAddr == conf.Prometheus.ListenAddr)
+		}
+		if health && (gauges == nil || conf.Health.ListenAddr != conf.Prometheus.ListenAddr) {
+			log.Info("starting ServeHealth")
+			wg.Add(1)
+			go ServeHealth(&wg, stop, conf.Health.ListenAddr)
+		}
+		if conf.Debug.ListenAddr != "" && !once {
+			log.Info("starting ServeDebug")
+			wg.Add(1)
+			go ServeDebug(&wg, stop, conf.Debug.ListenAddr)
+		}
+		if !once {
+			wg.Add(1)
+			go NotifySystemd(&wg, stop)
+		}
+
+		if once {
+			// collect a single time then stop, WriteMetrics flushes what was
+			// collected before returning
+			stopErr = collectOnce(clk, clients, metrics)
+			Stop(stop)
 		}
-		log.Info("starting RemoteWriter")
-		wg.Add(1)
-		go RemoteWrite(&wg, stop, metrics, conf)
 
-		wg.Wait()
+		for running := !once; running; {
+			select {
+			case sig := <-sigs:
+				if sig == syscall.SIGHUP {
+					log.Infof("received signal %s, reloading config", sig)
+					prev := conf.outputs()
+					conf = cs.reload(conf)
+					for i, out := range conf.outputs() {
+						if i < len(reloads) && !reflect.DeepEqual(out.Prometheus, prev[i].Prometheus) {
+							// replace rather than queue behind a config not
+							// yet taken
+							select {
+							case <-reloads[i]:
+							default:
+							}
+							reloads[i] <- out
+						}
+					}
+					continue
+				}
+				log.Infof("received signal %s, draining", sig)
+				Stop(stop)
+				running = false
+			case <-stop:
+				// stopped by a goroutine rather than a signal
+				stopErr = errors.New("stopped after unrecoverable error, see log for details")
+				running = false
+			}
+		}
 
-		return nil
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		timeout := time.Duration(conf.ShutdownTimeout)*time.Second + shutdownGrace
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			log.Warningf("timed out after %s waiting for goroutines to stop", timeout)
+		}
+
+		return stopErr
 	},
 }
 
-func Execute() {
-	cobra.CheckErr(daemonCmd.Execute())
+func init() {
+	daemonCmd.PersistentFlags().StringP("config", "c", "", "config file, taking precedence over the config argument")
+	daemonCmd.Flags().Bool("stdout", false, "print samples to stdout as JSON lines instead of using the configured output")
+	daemonCmd.Flags().Bool("once", false, "collect from each device once, push and exit")
+	daemonCmd.Flags().Bool("dry-run", false, "log what would be written to the output instead of writing it")
 }
 
-func RemoteWrite(wg *sync.WaitGroup, stop chan bool, metrics chan prompb.TimeSeries, conf Config) {
-	var ok bool
-	var ts prompb.TimeSeries
-	var err error
-	var data []byte
-	var writeReq *prompb.WriteRequest
-	var c remote.WriteClient
-	var endpoint *url.URL
-	var encoded []byte
-
-	if endpoint, err = url.Parse(conf.Prometheus.Endpoint); err != nil {
-		log.Fatal("cannot parse endpoint url, stopping")
+// Stop closes the stop channel, signalling all goroutines to finish. It is
+// safe to call more than once.
+func Stop(stop chan bool) {
+	stopOnce.Do(func() {
 		close(stop)
-		return
-	}
+	})
+}
 
-	c, err = remote.NewWriteClient(
-		"tapo",
-		&remote.ClientConfig{
-			URL:     &config.URL{URL: endpoint},
-			Timeout: model.Duration(30 * time.Second),
-			HTTPClientConfig: config.HTTPClientConfig{
-				BasicAuth: &config.BasicAuth{
-					Username: conf.Prometheus.Username,
-					Password: config.Secret(conf.Prometheus.Password),
-				},
-			},
-			RetryOnRateLimit: true,
-		},
-	)
-	if err != nil {
-		log.Fatal("error %s", err)
-		close(stop)
-		return
+// firstArg returns the first of args, or "" if there are none.
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
 	}
-
-	// offset start time by 1 second
-	time.Sleep(time.Second)
-
-	ticker := time.NewTicker(time.Duration(conf.Prometheus.FlushInterval) * time.Second)
-
-	var tss []prompb.TimeSeries
-	for {
-		select {
-		case _, ok = <-stop:
-			if !ok {
-				ticker.Stop()
-				log.Info("stopping RemoteWrite")
-				wg.Done()
-				return
-			}
-
-		case ts = <-metrics:
-			log.Debug("received time-series")
-			tss = append(tss, ts)
-
-		case <-ticker.C:
-			log.Debugf("performing batched remote write for %d timeseries", len(tss))
-			if len(tss) == 0 {
-				continue
-			}
-			writeReq = &prompb.WriteRequest{Timeseries: tss}
-			data, err = proto.Marshal(writeReq)
-			if err != nil {
-				log.Fatalf("unable to marshal protobuf: %v", err)
-				close(stop)
-				continue
-			}
-			encoded = snappy.Encode(nil, data)
-			if err = c.Store(context.TODO(), encoded); err != nil {
-				if _, ok := err.(remote.RecoverableError); ok {
-					log.Infof("recoverable error %s", err.Error())
-					continue
-				}
-				log.Fatalf("error pushing timeseries: %s", err)
-				close(stop)
-				continue
-			}
-			log.Infof("pushed %d timeseries", len(tss))
-			tss = []prompb.TimeSeries{}
-		}
-	}
-
+	return args[0]
 }
 
-func CollectEnergyUsage(wg *sync.WaitGroup, stop chan bool, interval int, c client, metrics chan prompb.TimeSeries) {
-	var r map[string]interface{}
-	var err error
-	var ok bool
-	var v float64
-
-	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+func Execute() {
+	cobra.CheckErr(daemonCmd.Execute())
+}
 
-	for {
-		select {
-		case _, ok = <-stop:
-			if !ok {
-				ticker.Stop()
-				log.Infof("stopping CollectEnergyUsage %s", c.d.Ip)
-				wg.Done()
-				return
-			}
-		case <-ticker.C:
-			r, err = c.t.GetEnergyUsage()
-			if err != nil {
-				log.Warning(err.Error())
-			}
-			if r["error_code"] != float64(0) {
-				log.Warning("non zero error code")
-			}
-			v = r["result"].(map[string]interface{})["current_power"].(float64)
-			metrics <- prompb.TimeSeries{
-				Labels: []prompb.Label{
-					{Name: "ip", Value: c.d.Ip},
-					{Name: "__name__", Value: "current_power"},
-				},
-				Samples: []prompb.Sample{{
-					Timestamp: time.Now().UnixMilli(),
-					Value:     v,
-				}},
-			}
-		}
+// withDryRun returns conf set to log what would be written in place of
+// writing when dryRun is set, leaving any buffer of the real output
+// untouched.
+func withDryRun(conf Config, dryRun bool) Config {
+	if conf.dryRun = dryRun; dryRun {
+		conf.Prometheus.BufferPath = ""
 	}
+	return conf
 }
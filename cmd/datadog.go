@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// datadogGauge is the series type of a gauge in the v2 series API.
+const datadogGauge = 3
+
+type (
+	// datadogWriter is a Writer submitting gauges to the Datadog v2 series
+	// API.
+	datadogWriter struct {
+		url    string
+		apiKey string
+		tags   []string
+		client *http.Client
+	}
+	datadogPayload struct {
+		Series []datadogSeries `json:"series"`
+	}
+	datadogSeries struct {
+		Metric string         `json:"metric"`
+		Type   int            `json:"type"`
+		Points []datadogPoint `json:"points"`
+		Tags   []string       `json:"tags,omitempty"`
+	}
+	datadogPoint struct {
+		Timestamp int64   `json:"timestamp"`
+		Value     float64 `json:"value"`
+	}
+)
+
+func newDatadogWriter(conf Config) (*datadogWriter, error) {
+	u, err := url.Parse("https://api." + conf.Datadog.Site)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse Datadog site: %w", err)
+	}
+	return &datadogWriter{
+		url:    u.JoinPath("/api/v2/series").String(),
+		apiKey: conf.Datadog.APIKey,
+		tags:   conf.Datadog.Tags,
+		client: newHTTPClient(conf),
+	}, nil
+}
+
+// Write submits tss as gauges tagged with each label and the configured
+// tags. Staleness markers are skipped as Datadog has no equivalent.
+func (w *datadogWriter) Write(ctx context.Context, tss []prompb.TimeSeries) error {
+	var body []byte
+	var req *http.Request
+	var res *http.Response
+	var err error
+
+	payload := datadogPayload{Series: []datadogSeries{}}
+	for _, ts := range tss {
+		s := datadogSeries{Type: datadogGauge, Tags: append([]string{}, w.tags...)}
+		for _, l := range ts.Labels {
+			switch {
+			case l.Name == "__name__":
+				s.Metric = l.Value
+			case l.Value != "":
+				s.Tags = append(s.Tags, l.Name+":"+l.Value)
+			}
+		}
+		for _, sample := range ts.Samples {
+			if !value.IsStaleNaN(sample.Value) {
+				s.Points = append(s.Points, datadogPoint{Timestamp: sample.Timestamp / 1000, Value: sample.Value})
+			}
+		}
+		if len(s.Points) > 0 {
+			payload.Series = append(payload.Series, s)
+		}
+	}
+	if body, err = json.Marshal(payload); err != nil {
+		return fmt.Errorf("%w: %s", errMarshal, err)
+	}
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body)); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", w.apiKey)
+	if res, err = w.client.Do(req); err != nil {
+		return recoverableError{err}
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	switch {
+	case res.StatusCode/100 == 2:
+		return nil
+	// rate limited requests are retried with the usual backoff
+	case res.StatusCode/100 == 5 || res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusRequestTimeout:
+		return recoverableError{fmt.Errorf("server returned HTTP status %s: %s", res.Status, msg)}
+	}
+	return fmt.Errorf("server returned HTTP status %s: %s", res.Status, msg)
+}
@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+)
+
+// ServeDebug exposes the pprof profiles on /debug/pprof/ and expvar on
+// /debug/vars at addr until stop is closed. addr should not be reachable from
+// untrusted networks.
+func ServeDebug(wg *sync.WaitGroup, stop chan bool, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	serve(wg, stop, addr, "debug", mux)
+}
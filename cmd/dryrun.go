@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+type (
+	// dryRunWriter is a Writer logging what would be written to an output
+	// in place of writing it.
+	dryRunWriter struct {
+		output string
+	}
+)
+
+func newDryRunWriter(conf Config) *dryRunWriter {
+	return &dryRunWriter{output: outputString(conf)}
+}
+
+// Write logs the number of time-series in tss and, at debug level, each
+// time-series.
+func (w *dryRunWriter) Write(_ context.Context, tss []prompb.TimeSeries) error {
+	log.Infof("dry run, would write %d timeseries to %s", len(tss), w.output)
+	if !log.IsLevelEnabled(log.DebugLevel) {
+		return nil
+	}
+	for _, ts := range tss {
+		for _, s := range ts.Samples {
+			log.Debugf("dry run, would write %s %g %d", seriesString(ts.Labels), s.Value, s.Timestamp)
+		}
+	}
+	return nil
+}
+
+// seriesString formats ls as in the Prometheus text format, e.g.
+// current_power{ip="192.168.1.69"}.
+func seriesString(ls []prompb.Label) string {
+	var name string
+	var pairs []string
+
+	for _, l := range ls {
+		if l.Name == "__name__" {
+			name = l.Value
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", l.Name, l.Value))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
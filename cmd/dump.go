@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"strings"
+	"time"
+)
+
+// dumpRedacted are the response fields replaced by dump as they identify the
+// device, its network or its location
+var dumpRedacted = map[string]bool{
+	"device_id": true,
+	"hw_id":     true,
+	"fw_id":     true,
+	"oem_id":    true,
+	"mac":       true,
+	"ssid":      true,
+	"latitude":  true,
+	"longitude": true,
+}
+
+var dumpCmd = &cobra.Command{
+	Use:   "dump [config] <device>",
+	Short: "Print the raw device info and energy usage responses of devices",
+	Long: `Print the device info and energy usage responses of devices as JSON, one object
+per device, for troubleshooting fields missing or named differently by some
+firmware. The device is selected by ip or name from the config, or * to select
+all devices. Identifiers, the network name and location are redacted.`,
+	Args:              cobra.RangeArgs(1, 2),
+	ValidArgsFunction: completeDump,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var conf Config
+		var config string
+		var path string
+		var devices []Device
+		var c client
+		var r map[string]interface{}
+		var b []byte
+		var failed bool
+		var err error
+
+		if len(args) == 2 {
+			config, args = args[0], args[1:]
+		}
+		if path, err = configFile(cmd, config); err != nil {
+			return err
+		}
+		viper.SetConfigFile(path)
+		if conf, err = loadConfig(); err != nil {
+			return err
+		}
+		setCollection(conf)
+		if devices = selectDevices(conf.Devices, args[0], ""); len(devices) == 0 {
+			return fmt.Errorf("no devices match %s", args[0])
+		}
+
+		for _, d := range devices {
+			out := map[string]interface{}{"device": deviceString(d)}
+			if c, err = connectWithin(d, time.Duration(conf.ConnectTimeout)*time.Second); err != nil {
+				out["error"] = fmt.Sprintf("could not connect: %s", err)
+				failed = true
+			} else {
+				for method, fn := range map[string]func() (map[string]interface{}, error){
+					"get_device_info":  c.t.DeviceInfo,
+					"get_energy_usage": c.t.GetEnergyUsage,
+				} {
+					if r, err = c.call(fn); err != nil {
+						out[method] = map[string]interface{}{"error": err.Error()}
+						failed = true
+						continue
+					}
+					out[method] = redact(r)
+				}
+			}
+			if b, err = json.MarshalIndent(out, "", "  "); err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+		}
+
+		if failed {
+			return errors.New("one or more devices could not be read")
+		}
+		return nil
+	},
+}
+
+// redact returns v with the values of dumpRedacted fields and of any field
+// named like a credential replaced, at any depth.
+func redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			name := strings.ToLower(k)
+			if dumpRedacted[name] || strings.Contains(name, "password") || strings.Contains(name, "token") || strings.Contains(name, "key") {
+				out[k] = "REDACTED"
+				continue
+			}
+			out[k] = redact(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = redact(e)
+		}
+		return out
+	}
+	return v
+}
+
+func init() {
+	daemonCmd.AddCommand(dumpCmd)
+}
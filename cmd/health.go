@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// readinessState tracks what /readyz waits for, a successful reading
+	// from any device and the construction of every Writer.
+	readinessState struct {
+		collected      atomic.Bool
+		pendingWriters atomic.Int64
+	}
+)
+
+var readiness readinessState
+
+// handleHealth adds /healthz, always reporting healthy while the daemon is
+// running, and /readyz to mux.
+func handleHealth(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !readiness.collected.Load():
+			http.Error(w, "waiting for a reading from a device", http.StatusServiceUnavailable)
+		case readiness.pendingWriters.Load() > 0:
+			http.Error(w, "waiting for the output writer", http.StatusServiceUnavailable)
+		default:
+			_, _ = w.Write([]byte("ok\n"))
+		}
+	})
+}
+
+// ready reports whether a device has been read and every Writer created.
+func (r *readinessState) ready() bool {
+	return r.collected.Load() && r.pendingWriters.Load() == 0
+}
+
+// ServeHealth exposes /healthz and /readyz on addr until stop is closed.
+func ServeHealth(wg *sync.WaitGroup, stop chan bool, addr string) {
+	mux := http.NewServeMux()
+	handleHealth(mux)
+	serve(wg, stop, addr, "health", mux)
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+type (
+	// influxWriter is a Writer posting InfluxDB line protocol to the v2 write
+	// API.
+	influxWriter struct {
+		url    string
+		token  string
+		client *http.Client
+	}
+)
+
+func newInfluxWriter(conf Config) (*influxWriter, error) {
+	u, err := url.Parse(conf.InfluxDB.URL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse InfluxDB url: %w", err)
+	}
+	u = u.JoinPath("/api/v2/write")
+	u.RawQuery = url.Values{
+		"org":       {conf.InfluxDB.Org},
+		"bucket":    {conf.InfluxDB.Bucket},
+		"precision": {"ms"},
+	}.Encode()
+	return &influxWriter{
+		url:    u.String(),
+		token:  conf.InfluxDB.Token,
+		client: newHTTPClient(conf),
+	}, nil
+}
+
+// Write posts tss as line protocol, one line per sample with the metric name
+// as the measurement, the remaining labels as tags and a single value field.
+func (w *influxWriter) Write(ctx context.Context, tss []prompb.TimeSeries) error {
+	var buf bytes.Buffer
+	var req *http.Request
+	var res *http.Response
+	var err error
+
+	for _, ts := range tss {
+		writeLineProtocol(&buf, ts)
+	}
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, w.url, &buf); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+	if res, err = w.client.Do(req); err != nil {
+		return recoverableError{err}
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	switch {
+	case res.StatusCode/100 == 2:
+		return nil
+	case res.StatusCode/100 == 5 || res.StatusCode == http.StatusTooManyRequests:
+		return recoverableError{fmt.Errorf("server returned HTTP status %s: %s", res.Status, body)}
+	}
+	return fmt.Errorf("server returned HTTP status %s: %s", res.Status, body)
+}
+
+// writeLineProtocol appends a line for each sample in ts to buf.
+func writeLineProtocol(buf *bytes.Buffer, ts prompb.TimeSeries) {
+	var measurement string
+	var tags strings.Builder
+
+	for _, l := range ts.Labels {
+		if l.Name == "__name__" {
+			measurement = influxMeasurementEscaper.Replace(l.Value)
+			continue
+		}
+		if l.Value == "" {
+			continue
+		}
+		tags.WriteString(",")
+		tags.WriteString(influxTagEscaper.Replace(l.Name))
+		tags.WriteString("=")
+		tags.WriteString(influxTagEscaper.Replace(l.Value))
+	}
+	for _, s := range ts.Samples {
+		buf.WriteString(measurement)
+		buf.WriteString(tags.String())
+		buf.WriteString(" value=")
+		buf.WriteString(strconv.FormatFloat(s.Value, 'f', -1, 64))
+		buf.WriteString(" ")
+		buf.WriteString(strconv.FormatInt(s.Timestamp, 10))
+		buf.WriteString("\n")
+	}
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"net/url"
+	"runtime"
+	"time"
+)
+
+// metrics describing tapmon itself, exposed on the /metrics endpoint when
+// Prometheus.ListenAddr is configured
+var (
+	collectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tapmon_collections_total",
+		Help: "Number of collections from each device by result.",
+	}, []string{"ip", "result"})
+	writesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tapmon_writes_total",
+		Help: "Number of batches written to the output by result.",
+	}, []string{"result"})
+	writeBatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tapmon_write_batch_timeseries",
+		Help:    "Number of timeseries in each batch written to the output.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	})
+	writeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tapmon_write_duration_seconds",
+		Help:    "Time taken to write each batch to the output, including retries.",
+		Buckets: prometheus.DefBuckets,
+	})
+	writesInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tapmon_write_requests_in_flight",
+		Help: "Number of write requests to the outputs currently in flight.",
+	})
+	circuitOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tapmon_device_circuit_open",
+		Help: "1 while the circuit breaker of each device is open and it is only probed, else 0.",
+	}, []string{"ip"})
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tapmon_build_info",
+		Help: "Always 1, labelled with the version, commit and Go version tapmon was built with.",
+	}, []string{"version", "commit", "goversion"})
+	droppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tapmon_dropped_timeseries_total",
+		Help: "Number of timeseries dropped because the queue was full.",
+	})
+	expiredTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tapmon_expired_samples_total",
+		Help: "Number of samples dropped before writing for being older than the buffer retention or maximum sample age.",
+	})
+)
+
+// metrics about writes to each output named and labelled like those of the
+// Prometheus remote write queue manager, so that its dashboards can be reused
+var (
+	remoteSamplesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_remote_storage_samples_total",
+		Help: "Total number of samples sent to remote storage.",
+	}, []string{"remote_name", "url"})
+	remoteSamplesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_remote_storage_samples_failed_total",
+		Help: "Total number of samples which failed on send to remote storage, non-recoverable errors.",
+	}, []string{"remote_name", "url"})
+	remoteSamplesRetried = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_remote_storage_samples_retried_total",
+		Help: "Total number of samples which failed on send to remote storage but were retried because the send error was recoverable.",
+	}, []string{"remote_name", "url"})
+	remoteSamplesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_remote_storage_samples_dropped_total",
+		Help: "Total number of samples which were dropped before being sent to remote storage.",
+	}, []string{"remote_name", "url"})
+	remoteSamplesPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_remote_storage_samples_pending",
+		Help: "The number of samples pending in the queue to be sent to the remote storage.",
+	}, []string{"remote_name", "url"})
+	remoteHighestSent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_remote_storage_queue_highest_sent_timestamp_seconds",
+		Help: "Timestamp from a WAL sample, the highest timestamp successfully sent by this queue, in seconds since epoch.",
+	}, []string{"remote_name", "url"})
+	remoteBatchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prometheus_remote_storage_sent_batch_duration_seconds",
+		Help:    "Duration of send calls to the remote storage.",
+		Buckets: append(prometheus.DefBuckets, 25, 60, 120, 300),
+	}, []string{"remote_name", "url"})
+)
+
+type (
+	// remoteStorage holds the prometheus_remote_storage metrics of an
+	// output, remote_name being the Output and url the remote write
+	// endpoint, if any.
+	remoteStorage struct {
+		samples  prometheus.Counter
+		failed   prometheus.Counter
+		retried  prometheus.Counter
+		dropped  prometheus.Counter
+		pending  prometheus.Gauge
+		duration prometheus.Observer
+		sent     prometheus.Gauge
+		// highest is the highest timestamp sent, in milliseconds
+		highest int64
+	}
+)
+
+func init() {
+	prometheus.MustRegister(collectionsTotal, writesTotal, writeBatchSize, writeDuration, writesInFlight, circuitOpen, droppedTotal, expiredTotal, buildInfo)
+	prometheus.MustRegister(remoteSamplesTotal, remoteSamplesFailed, remoteSamplesRetried, remoteSamplesDropped, remoteSamplesPending, remoteHighestSent, remoteBatchDuration)
+	buildInfo.WithLabelValues(version, commit, runtime.Version()).Set(1)
+}
+
+// registerQueueLength exposes the number of time-series waiting in metrics.
+func registerQueueLength(metrics queues) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tapmon_queue_length",
+		Help: "Number of timeseries queued for writing to the output.",
+	}, func() float64 {
+		var n int
+		for _, q := range metrics {
+			n += len(q)
+		}
+		return float64(n)
+	}))
+}
+
+// newRemoteStorage returns the remoteStorage metrics of the output conf.
+func newRemoteStorage(conf Config) *remoteStorage {
+	var endpoint string
+
+	if conf.Output == OutputPrometheus {
+		endpoint = conf.Prometheus.Endpoint
+		// credentials in the endpoint are not exposed
+		if u, err := url.Parse(endpoint); err == nil {
+			endpoint = u.Redacted()
+		}
+	}
+	l := prometheus.Labels{"remote_name": conf.Output, "url": endpoint}
+	return &remoteStorage{
+		samples:  remoteSamplesTotal.With(l),
+		failed:   remoteSamplesFailed.With(l),
+		retried:  remoteSamplesRetried.With(l),
+		dropped:  remoteSamplesDropped.With(l),
+		pending:  remoteSamplesPending.With(l),
+		duration: remoteBatchDuration.With(l),
+		sent:     remoteHighestSent.With(l),
+	}
+}
+
+// markSent records that tss were sent, raising the highest sent timestamp.
+func (r *remoteStorage) markSent(tss []prompb.TimeSeries) {
+	for _, ts := range tss {
+		for _, s := range ts.Samples {
+			if s.Timestamp > r.highest {
+				r.highest = s.Timestamp
+			}
+		}
+	}
+	r.sent.Set(float64(r.highest) / 1000)
+	r.pending.Sub(float64(sampleCount(tss)))
+}
+
+// buildInfoSeries returns tapmon_build_info as a time-series timestamped t,
+// for sending to the output once on startup.
+func buildInfoSeries(t time.Time) prompb.TimeSeries {
+	return prompb.TimeSeries{
+		Labels: seriesLabels(buildInfoMetric.fullName(),
+			prompb.Label{Name: "version", Value: version},
+			prompb.Label{Name: "commit", Value: commit},
+			prompb.Label{Name: "goversion", Value: runtime.Version()},
+		),
+		Samples: []prompb.Sample{{Timestamp: t.UnixMilli(), Value: 1}},
+	}
+}
+
+// result returns the result label value for err.
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
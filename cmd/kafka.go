@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"time"
+)
+
+const (
+	KafkaJSON     = "json"
+	KafkaProtobuf = "protobuf"
+
+	KafkaSASLPlain       = "plain"
+	KafkaSASLSCRAMSHA256 = "scram-sha-256"
+	KafkaSASLSCRAMSHA512 = "scram-sha-512"
+)
+
+type (
+	// kafkaWriter is a Writer producing a message per reading to a Kafka
+	// topic, keyed by device ip so that each device stays on a partition.
+	kafkaWriter struct {
+		w      *kafka.Writer
+		format string
+	}
+)
+
+func newKafkaWriter(conf Config) (*kafkaWriter, error) {
+	var mechanism sasl.Mechanism
+	var tlsConfig *tls.Config
+	var err error
+
+	k := conf.Kafka
+	if k.Username != "" || k.Password != "" {
+		if mechanism, err = kafkaSASL(k.SASLMechanism, k.Username, k.Password); err != nil {
+			return nil, fmt.Errorf("invalid Kafka config: %w", err)
+		}
+	}
+	if k.EnableTLS {
+		tlsConfig, err = config.NewTLSConfig(&config.TLSConfig{
+			CAFile:             k.TLS.CAFile,
+			CertFile:           k.TLS.CertFile,
+			KeyFile:            k.TLS.KeyFile,
+			ServerName:         k.TLS.ServerName,
+			InsecureSkipVerify: k.TLS.InsecureSkipVerify,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid Kafka TLS config: %w", err)
+		}
+	}
+	return &kafkaWriter{
+		w: &kafka.Writer{
+			Addr:         kafka.TCP(k.Brokers...),
+			Topic:        k.Topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			// each flush is produced at once, so there is nothing to wait
+			// for to fill a batch
+			BatchSize:    conf.Prometheus.MaxSamplesPerSend,
+			BatchTimeout: 10 * time.Millisecond,
+			Transport: &kafka.Transport{
+				ClientID: conf.UserAgent,
+				TLS:      tlsConfig,
+				SASL:     mechanism,
+			},
+		},
+		format: k.Format,
+	}, nil
+}
+
+// kafkaSASL returns the SASL mechanism named name, plain when empty.
+func kafkaSASL(name, username, password string) (sasl.Mechanism, error) {
+	switch name {
+	case "", KafkaSASLPlain:
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case KafkaSASLSCRAMSHA256:
+		return scram.Mechanism(scram.SHA256, username, password)
+	case KafkaSASLSCRAMSHA512:
+		return scram.Mechanism(scram.SHA512, username, password)
+	}
+	return nil, fmt.Errorf("unknown SASLMechanism %s", name)
+}
+
+// Write produces a message per sample in tss as JSON, in the same format as
+// the stdout output, or per time-series as a protobuf prompb.TimeSeries. An
+// empty tss fetches the metadata of the topic instead, checking the brokers
+// are reachable. Errors other than those Kafka reports as permanent,
+// messages too large and failed authentication are recoverable.
+func (w *kafkaWriter) Write(ctx context.Context, tss []prompb.TimeSeries) error {
+	var msgs []kafka.Message
+
+	if len(tss) == 0 {
+		return w.check(ctx)
+	}
+	if w.format == KafkaProtobuf {
+		for i := range tss {
+			b, err := proto.Marshal(&tss[i])
+			if err != nil {
+				return fmt.Errorf("%w: %s", errMarshal, err)
+			}
+			msgs = append(msgs, kafka.Message{Key: []byte(labelValue(tss[i].Labels, "ip")), Value: b})
+		}
+	} else {
+		for _, s := range samples(tss) {
+			b, err := json.Marshal(s)
+			if err != nil {
+				return fmt.Errorf("%w: %s", errMarshal, err)
+			}
+			msgs = append(msgs, kafka.Message{Key: []byte(s.Ip), Value: b})
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	if err := w.w.WriteMessages(ctx, msgs...); err != nil {
+		return kafkaError(fmt.Errorf("could not produce to Kafka: %w", err))
+	}
+	return nil
+}
+
+// check fetches the metadata of the topic, failing unless a broker can be
+// reached, accepts the credentials and knows of the topic.
+func (w *kafkaWriter) check(ctx context.Context) error {
+	c := &kafka.Client{Addr: w.w.Addr, Transport: w.w.Transport}
+	res, err := c.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{w.w.Topic}})
+	if err == nil {
+		for _, t := range res.Topics {
+			if t.Error != nil {
+				err = fmt.Errorf("topic %s: %w", t.Name, t.Error)
+			}
+		}
+	}
+	if err != nil {
+		return kafkaError(fmt.Errorf("could not fetch Kafka metadata: %w", err))
+	}
+	return nil
+}
+
+// kafkaError returns err, marked recoverable unless it is permanent.
+func kafkaError(err error) error {
+	if kafkaPermanent(err) {
+		return err
+	}
+	return recoverableError{err}
+}
+
+// kafkaPermanent reports whether err will fail again if retried, an error
+// Kafka reports as permanent such as a failed authentication or
+// authorization, or a message too large.
+func kafkaPermanent(err error) bool {
+	var kerr kafka.Error
+	var writeErrs kafka.WriteErrors
+
+	switch {
+	case errors.As(err, &kafka.MessageTooLargeError{}):
+		return true
+	case errors.As(err, &writeErrs):
+		// each message failed or succeeded on its own
+		for _, e := range writeErrs {
+			if e != nil && kafkaPermanent(e) {
+				return true
+			}
+		}
+		return false
+	case errors.As(err, &kerr):
+		return !kerr.Temporary()
+	}
+	return false
+}
+
+// labelValue returns the value of the label called name in ls, or "".
+func labelValue(ls []prompb.Label, name string) string {
+	for _, l := range ls {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
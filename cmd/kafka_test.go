@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKafkaError(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		err         error
+		recoverable bool
+	}{
+		{name: "unreachable", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, recoverable: true},
+		{name: "temporary", err: kafka.LeaderNotAvailable, recoverable: true},
+		{name: "message too large", err: kafka.MessageTooLargeError{}},
+		{name: "authentication", err: fmt.Errorf("kafka.(*Client).Metadata: %w", kafka.SASLAuthenticationFailed)},
+		{name: "topic authorization", err: kafka.WriteErrors{nil, kafka.TopicAuthorizationFailed}},
+		{name: "temporary write errors", err: kafka.WriteErrors{kafka.NotEnoughReplicas, nil}, recoverable: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isRecoverable(kafkaError(tc.err)); got != tc.recoverable {
+				t.Errorf("got recoverable %t for %v, want %t", got, tc.err, tc.recoverable)
+			}
+		})
+	}
+}
+
+func TestKafkaCheck(t *testing.T) {
+	// a closed listener's address, refusing connections
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	conf := Config{}
+	conf.Kafka.Brokers, conf.Kafka.Topic = []string{addr}, "tapmon"
+	w, err := newKafkaWriter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = w.Write(ctx, nil); err == nil || !isRecoverable(err) {
+		t.Errorf("got error %v checking an unreachable broker, want a recoverable error", err)
+	}
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	metricGauge   = "gauge"
+	metricCounter = "counter"
+)
+
+type (
+	// metricDesc describes a metric written to the outputs. Series are built
+	// from their metricDesc so that the catalog printed by the metrics
+	// command matches what is written.
+	metricDesc struct {
+		name   string
+		kind   string
+		unit   string
+		labels []string
+		help   string
+		// global metrics are not prefixed with the namespace
+		global bool
+	}
+)
+
+var (
+	currentPowerMetric     = deviceMetric("current_power", metricGauge, "mW", "Instantaneous power draw", "channel")
+	voltageMetric          = deviceMetric("voltage", metricGauge, "V", "Supply voltage", "channel")
+	currentMetric          = deviceMetric("current", metricGauge, "A", "Current draw", "channel")
+	energyMetric           = deviceMetric("energy_wh_total", metricCounter, "Wh", "Energy used today, resetting at midnight", "channel")
+	todayEnergyMetric      = deviceMetric("today_energy", metricGauge, "Wh", "Energy used today", "channel")
+	monthEnergyMetric      = deviceMetric("month_energy", metricGauge, "Wh", "Energy used this month", "channel")
+	deviceOnMetric         = deviceMetric("device_on", metricGauge, "", "1 if switched on, else 0")
+	wifiRSSIMetric         = deviceMetric("wifi_rssi_dbm", metricGauge, "dBm", "Wi-Fi signal strength")
+	wifiSignalLevelMetric  = deviceMetric("wifi_signal_level", metricGauge, "", "Wi-Fi signal level, 0-4")
+	overheatedMetric       = deviceMetric("overheated", metricGauge, "", "1 if the device has overheated, else 0")
+	powerProtectionMetric  = deviceMetric("power_protection_on", metricGauge, "", "1 if overload protection has tripped, else 0")
+	uptimeMetric           = deviceMetric("uptime_seconds", metricGauge, "s", "Seconds since the device was switched on or restarted")
+	deviceInfoMetric       = deviceMetric("device_info", metricGauge, "", "Always 1, labelled with the nickname set in the Tapo app", "nickname")
+	collectionErrorsMetric = deviceMetric("collection_errors_total", metricCounter, "", "Failed polls of the device since tapmon started")
+	pollIntervalMetric     = deviceMetric("poll_interval_seconds", metricGauge, "s", "Interval the device is polled at, after any device override")
+	upMetric               = deviceMetric("up", metricGauge, "", "1 if the last poll of the device succeeded, else 0")
+	flushIntervalMetric    = metricDesc{name: "flush_interval_seconds", kind: metricGauge, unit: "s", help: "Interval timeseries are written at"}
+	buildInfoMetric        = metricDesc{name: "tapmon_build_info", kind: metricGauge, labels: []string{"version", "commit", "goversion"}, help: "Always 1, identifies the running build", global: true}
+	// catalog lists every metric written to the outputs, in the order the
+	// metrics command prints them
+	catalog = []metricDesc{
+		currentPowerMetric, voltageMetric, currentMetric, energyMetric, todayEnergyMetric, monthEnergyMetric,
+		deviceOnMetric, wifiRSSIMetric, wifiSignalLevelMetric, overheatedMetric, powerProtectionMetric, uptimeMetric,
+		deviceInfoMetric, collectionErrorsMetric, pollIntervalMetric, upMetric, flushIntervalMetric, buildInfoMetric,
+	}
+)
+
+var metricsCmd = &cobra.Command{
+	Use:   "metrics",
+	Short: "List the metrics written to the outputs",
+	Long: `List the name, type, unit and labels of each metric written to the outputs.
+Names are shown without the namespace set by prometheus.namespace.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tTYPE\tUNIT\tLABELS\tDESCRIPTION")
+		for _, m := range catalog {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", m.name, m.kind, m.unit, strings.Join(m.labels, ","), m.help)
+		}
+		return w.Flush()
+	},
+}
+
+// deviceMetric returns the metricDesc of a metric labelled by device ip and
+// name along with labels.
+func deviceMetric(name, kind, unit, help string, labels ...string) metricDesc {
+	return metricDesc{name: name, kind: kind, unit: unit, labels: append([]string{"ip", "name"}, labels...), help: help}
+}
+
+// fullName returns the name m is written with, prefixed with the namespace
+// unless m is global.
+func (m metricDesc) fullName() string {
+	if m.global {
+		return m.name
+	}
+	return metricName(m.name)
+}
+
+func init() {
+	daemonCmd.AddCommand(metricsCmd)
+}
@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/prometheus/prompb"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// mqttInvalid matches characters not allowed in a topic level or Home
+	// Assistant object id
+	mqttInvalid = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+	// mqttSensors describes each metric to Home Assistant by metric name
+	// without namespace, metrics not listed are discovered as plain sensors
+	mqttSensors = map[string]mqttSensor{
+		currentPowerMetric.name:     {component: "sensor", deviceClass: "power", unit: "W", stateClass: "measurement", valueTemplate: "{{ value | float / 1000 }}"},
+		voltageMetric.name:          {component: "sensor", deviceClass: "voltage", unit: "V", stateClass: "measurement"},
+		currentMetric.name:          {component: "sensor", deviceClass: "current", unit: "A", stateClass: "measurement"},
+		energyMetric.name:           {component: "sensor", deviceClass: "energy", unit: "Wh", stateClass: "total_increasing"},
+		todayEnergyMetric.name:      {component: "sensor", deviceClass: "energy", unit: "Wh", stateClass: "total_increasing"},
+		monthEnergyMetric.name:      {component: "sensor", deviceClass: "energy", unit: "Wh", stateClass: "total_increasing"},
+		wifiRSSIMetric.name:         {component: "sensor", deviceClass: "signal_strength", unit: "dBm", stateClass: "measurement"},
+		wifiSignalLevelMetric.name:  {component: "sensor", stateClass: "measurement"},
+		deviceOnMetric.name:         {component: "binary_sensor", deviceClass: "power"},
+		overheatedMetric.name:       {component: "binary_sensor", deviceClass: "heat"},
+		powerProtectionMetric.name:  {component: "binary_sensor", deviceClass: "problem"},
+		uptimeMetric.name:           {component: "sensor", deviceClass: "duration", unit: "s", stateClass: "measurement"},
+		collectionErrorsMetric.name: {component: "sensor", stateClass: "total_increasing"},
+		upMetric.name:               {component: "binary_sensor", deviceClass: "connectivity"},
+	}
+)
+
+type (
+	// mqttWriter is a Writer publishing the latest value of each metric to
+	// <Topic>/<device>/<metric> on an MQTT broker, optionally with Home
+	// Assistant discovery config.
+	mqttWriter struct {
+		client          mqtt.Client
+		topic           string
+		qos             byte
+		retain          bool
+		discovery       bool
+		discoveryPrefix string
+		// discovered holds the discovery topics already published
+		discovered map[string]bool
+	}
+	mqttSensor struct {
+		component     string
+		deviceClass   string
+		unit          string
+		stateClass    string
+		valueTemplate string
+	}
+	// mqttDiscoveryConfig is the Home Assistant MQTT discovery payload for a
+	// sensor or binary_sensor.
+	mqttDiscoveryConfig struct {
+		Name              string              `json:"name"`
+		UniqueID          string              `json:"unique_id"`
+		StateTopic        string              `json:"state_topic"`
+		DeviceClass       string              `json:"device_class,omitempty"`
+		UnitOfMeasurement string              `json:"unit_of_measurement,omitempty"`
+		StateClass        string              `json:"state_class,omitempty"`
+		ValueTemplate     string              `json:"value_template,omitempty"`
+		PayloadOn         string              `json:"payload_on,omitempty"`
+		PayloadOff        string              `json:"payload_off,omitempty"`
+		Device            mqttDiscoveryDevice `json:"device"`
+	}
+	mqttDiscoveryDevice struct {
+		Identifiers  []string `json:"identifiers"`
+		Name         string   `json:"name"`
+		Manufacturer string   `json:"manufacturer"`
+		Model        string   `json:"model"`
+	}
+)
+
+func newMQTTWriter(conf Config) (*mqttWriter, error) {
+	m := conf.MQTT
+	opts := mqtt.NewClientOptions().
+		AddBroker(m.Broker).
+		SetClientID(m.ClientID).
+		SetUsername(m.Username).
+		SetPassword(m.Password).
+		SetConnectTimeout(writeTimeout).
+		SetWriteTimeout(writeTimeout).
+		// reconnecting is left to the next flush so that a broker outage is
+		// retried like any other recoverable write error
+		SetAutoReconnect(false)
+	if m.TLS.CAFile != "" || m.TLS.CertFile != "" || m.TLS.InsecureSkipVerify || m.TLS.ServerName != "" {
+		t, err := config.NewTLSConfig(&config.TLSConfig{
+			CAFile:             m.TLS.CAFile,
+			CertFile:           m.TLS.CertFile,
+			KeyFile:            m.TLS.KeyFile,
+			ServerName:         m.TLS.ServerName,
+			InsecureSkipVerify: m.TLS.InsecureSkipVerify,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid MQTT TLS config: %w", err)
+		}
+		opts.SetTLSConfig(t)
+	}
+	return &mqttWriter{
+		client:          mqtt.NewClient(opts),
+		topic:           m.Topic,
+		qos:             byte(m.QoS),
+		retain:          m.Retain,
+		discovery:       m.Discovery,
+		discoveryPrefix: m.DiscoveryPrefix,
+		discovered:      make(map[string]bool),
+	}, nil
+}
+
+// Write publishes the latest sample of each metric in tss for each device,
+// connecting to the broker first if not connected. Discovery config is
+// published, always retained, the first time a device's metric is seen.
+func (w *mqttWriter) Write(ctx context.Context, tss []prompb.TimeSeries) error {
+	var topics []string
+	var tokens []mqtt.Token
+
+	if !w.client.IsConnectionOpen() {
+		if err := mqttWait(ctx, w.client.Connect()); err != nil {
+			return recoverableError{fmt.Errorf("could not connect to MQTT broker: %w", err)}
+		}
+	}
+
+	// latest sample by state topic
+	latest := make(map[string]sample)
+	for _, s := range samples(tss) {
+		// tapmon's own metrics belong to no device
+		if s.Ip == "" {
+			continue
+		}
+		topic := fmt.Sprintf("%s/%s/%s", w.topic, mqttDeviceID(s), mqttMetricID(s))
+		if _, ok := latest[topic]; !ok {
+			topics = append(topics, topic)
+		}
+		latest[topic] = s
+	}
+	sort.Strings(topics)
+
+	discovered := make(map[string]bool)
+	for _, topic := range topics {
+		s := latest[topic]
+		if w.discovery {
+			dt, payload, err := w.discoveryConfig(topic, s)
+			if err != nil {
+				return fmt.Errorf("%w: %s", errMarshal, err)
+			}
+			if !w.discovered[dt] {
+				tokens = append(tokens, w.client.Publish(dt, w.qos, true, payload))
+				discovered[dt] = true
+			}
+		}
+		tokens = append(tokens, w.client.Publish(topic, w.qos, w.retain, strconv.FormatFloat(s.Value, 'f', -1, 64)))
+	}
+	for _, t := range tokens {
+		if err := mqttWait(ctx, t); err != nil {
+			return recoverableError{fmt.Errorf("could not publish to MQTT broker: %w", err)}
+		}
+	}
+	for dt := range discovered {
+		w.discovered[dt] = true
+	}
+	return nil
+}
+
+// discoveryConfig returns the Home Assistant discovery topic and payload for
+// the metric of s published to topic.
+func (w *mqttWriter) discoveryConfig(topic string, s sample) (string, []byte, error) {
+	id := mqttDeviceID(s)
+	metric := strings.TrimPrefix(s.Metric, metricName(""))
+	sensor, ok := mqttSensors[metric]
+	if !ok {
+		sensor = mqttSensor{component: "sensor", stateClass: "measurement"}
+	}
+	name := s.Name
+	if name == "" {
+		name = s.Ip
+	}
+	if s.Channel != "" {
+		metric += " channel " + s.Channel
+	}
+	c := mqttDiscoveryConfig{
+		Name:              metric,
+		UniqueID:          fmt.Sprintf("tapmon_%s_%s", id, mqttMetricID(s)),
+		StateTopic:        topic,
+		DeviceClass:       sensor.deviceClass,
+		UnitOfMeasurement: sensor.unit,
+		StateClass:        sensor.stateClass,
+		ValueTemplate:     sensor.valueTemplate,
+		Device: mqttDiscoveryDevice{
+			Identifiers:  []string{"tapmon_" + mqttInvalid.ReplaceAllString(s.Ip, "_")},
+			Name:         name,
+			Manufacturer: "TP-Link",
+			Model:        "Tapo",
+		},
+	}
+	if sensor.component == "binary_sensor" {
+		c.PayloadOn, c.PayloadOff = "1", "0"
+	}
+	payload, err := json.Marshal(c)
+	dt := fmt.Sprintf("%s/%s/tapmon_%s/%s/config", w.discoveryPrefix, sensor.component, id, mqttMetricID(s))
+	return dt, payload, err
+}
+
+// mqttDeviceID identifies the device of s in topics, by name when configured
+// and otherwise by ip.
+func mqttDeviceID(s sample) string {
+	if s.Name != "" {
+		return mqttInvalid.ReplaceAllString(s.Name, "_")
+	}
+	return mqttInvalid.ReplaceAllString(s.Ip, "_")
+}
+
+// mqttMetricID identifies the metric of s in topics, suffixed with its
+// channel for multi-channel devices.
+func mqttMetricID(s sample) string {
+	if s.Channel != "" {
+		return mqttInvalid.ReplaceAllString(s.Metric+"_"+s.Channel, "_")
+	}
+	return mqttInvalid.ReplaceAllString(s.Metric, "_")
+}
+
+// mqttWait waits for t to complete or ctx to be done.
+func mqttWait(ctx context.Context, t mqtt.Token) error {
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// otlpWriter is a Writer exporting gauges to an OpenTelemetry collector
+	// using OTLP/HTTP with JSON encoding.
+	otlpWriter struct {
+		url     string
+		headers map[string]string
+		client  *http.Client
+	}
+	// the following types are the subset of the OTLP metrics protobuf JSON
+	// mapping needed to export gauges
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpMetric struct {
+		Name  string    `json:"name"`
+		Gauge otlpGauge `json:"gauge"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+	}
+	otlpDataPoint struct {
+		Attributes   []otlpAttribute `json:"attributes"`
+		TimeUnixNano string          `json:"timeUnixNano"`
+		AsDouble     float64         `json:"asDouble"`
+	}
+	otlpAttribute struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+func newOTLPWriter(conf Config) (*otlpWriter, error) {
+	endpoint := conf.OTLP.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		scheme := "https://"
+		if conf.OTLP.Insecure {
+			scheme = "http://"
+		}
+		endpoint = scheme + endpoint
+	}
+	return &otlpWriter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/metrics",
+		headers: conf.OTLP.Headers,
+		client:  newHTTPClient(conf),
+	}, nil
+}
+
+// Write exports tss as OTLP gauges, one metric per metric name with a data
+// point per sample carrying the remaining labels as attributes.
+func (w *otlpWriter) Write(ctx context.Context, tss []prompb.TimeSeries) error {
+	var body []byte
+	var req *http.Request
+	var res *http.Response
+	var err error
+
+	if body, err = json.Marshal(otlpMetrics(tss)); err != nil {
+		return fmt.Errorf("%w: %s", errMarshal, err)
+	}
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body)); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	if res, err = w.client.Do(req); err != nil {
+		return recoverableError{err}
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusAccepted, http.StatusNoContent:
+		return nil
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return recoverableError{fmt.Errorf("server returned HTTP status %s: %s", res.Status, msg)}
+	}
+	return fmt.Errorf("server returned HTTP status %s: %s", res.Status, msg)
+}
+
+// otlpMetrics groups tss by metric name into an export request.
+func otlpMetrics(tss []prompb.TimeSeries) otlpRequest {
+	var metrics []otlpMetric
+	index := make(map[string]int)
+
+	for _, ts := range tss {
+		var name string
+		var attrs []otlpAttribute
+		for _, l := range ts.Labels {
+			if l.Name == "__name__" {
+				name = l.Value
+				continue
+			}
+			attrs = append(attrs, otlpAttribute{Key: l.Name, Value: otlpAnyValue{StringValue: l.Value}})
+		}
+		i, ok := index[name]
+		if !ok {
+			i = len(metrics)
+			index[name] = i
+			metrics = append(metrics, otlpMetric{Name: name})
+		}
+		for _, s := range ts.Samples {
+			metrics[i].Gauge.DataPoints = append(metrics[i].Gauge.DataPoints, otlpDataPoint{
+				Attributes:   attrs,
+				TimeUnixNano: strconv.FormatInt(s.Timestamp*int64(time.Millisecond), 10),
+				AsDouble:     s.Value,
+			})
+		}
+	}
+
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpAnyValue{StringValue: "tapmon"}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "tapmon"},
+			Metrics: metrics,
+		}},
+	}}}
+}
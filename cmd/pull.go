@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// gaugeSet holds the metrics exposed on the /metrics endpoint in pull
+	// mode, one GaugeVec per metric name labelled by device ip and name, or a
+	// counterVec for the counters of the catalog.
+	gaugeSet struct {
+		mu       sync.Mutex
+		reg      prometheus.Registerer
+		vecs     map[string]*prometheus.GaugeVec
+		counters map[string]*counterVec
+	}
+	// counterVec exposes counters whose values are read from the devices or
+	// the pollers rather than incremented, such as energy_wh_total.
+	counterVec struct {
+		mu     sync.Mutex
+		desc   *prometheus.Desc
+		names  []string
+		values map[string]counterValue
+	}
+	counterValue struct {
+		labels []string
+		value  float64
+	}
+)
+
+func newGaugeSet(reg prometheus.Registerer) *gaugeSet {
+	return &gaugeSet{reg: reg, vecs: make(map[string]*prometheus.GaugeVec), counters: make(map[string]*counterVec)}
+}
+
+// set updates the gauge or counter corresponding to ts with its latest
+// sample. Metrics are labelled by device ip, name and channel, empty for
+// single channel devices, along with any further labels of ts.
+func (g *gaugeSet) set(ts prompb.TimeSeries) {
+	var name string
+	var vec *prometheus.GaugeVec
+	var counter *counterVec
+	var gauge prometheus.Gauge
+	var ok bool
+	var err error
+
+	if len(ts.Samples) == 0 {
+		return
+	}
+	labels := prometheus.Labels{"ip": "", "name": "", "channel": ""}
+	for _, l := range ts.Labels {
+		if l.Name == "__name__" {
+			name = l.Value
+			continue
+		}
+		labels[l.Name] = l.Value
+	}
+
+	names := make([]string, 0, len(labels))
+	for l := range labels {
+		names = append(names, l)
+	}
+	sort.Strings(names)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if isCounter(name) {
+		if counter, ok = g.counters[name]; !ok {
+			counter = newCounterVec(name, names)
+			if err = g.reg.Register(counter); err != nil {
+				log.Warningf("could not register counter %s: %s", name, err)
+				return
+			}
+			g.counters[name] = counter
+		}
+		if err = counter.set(labels, ts.Samples[len(ts.Samples)-1].Value); err != nil {
+			log.Warningf("could not set counter %s: %s", name, err)
+		}
+		return
+	}
+	if vec, ok = g.vecs[name]; !ok {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name}, names)
+		if err = g.reg.Register(vec); err != nil {
+			log.Warningf("could not register gauge %s: %s", name, err)
+			return
+		}
+		g.vecs[name] = vec
+	}
+	if gauge, err = vec.GetMetricWith(labels); err != nil {
+		log.Warningf("could not set gauge %s: %s", name, err)
+		return
+	}
+	gauge.Set(ts.Samples[len(ts.Samples)-1].Value)
+}
+
+// delete removes all gauges and counters for the device with ip.
+func (g *gaugeSet) delete(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, vec := range g.vecs {
+		vec.DeletePartialMatch(prometheus.Labels{"ip": ip})
+	}
+	for _, counter := range g.counters {
+		counter.delete(ip)
+	}
+}
+
+// isCounter reports whether the metric named name is a counter of the
+// catalog.
+func isCounter(name string) bool {
+	for _, m := range catalog {
+		if m.fullName() == name {
+			return m.kind == metricCounter
+		}
+	}
+	return false
+}
+
+func newCounterVec(name string, names []string) *counterVec {
+	return &counterVec{
+		desc:   prometheus.NewDesc(name, "", names, nil),
+		names:  names,
+		values: make(map[string]counterValue),
+	}
+}
+
+// set sets the counter with labels to value, failing unless labels are those
+// of c.
+func (c *counterVec) set(labels prometheus.Labels, value float64) error {
+	if len(labels) != len(c.names) {
+		return fmt.Errorf("got %d labels, want %d", len(labels), len(c.names))
+	}
+	values := make([]string, len(c.names))
+	for i, n := range c.names {
+		v, ok := labels[n]
+		if !ok {
+			return fmt.Errorf("missing label %s", n)
+		}
+		values[i] = v
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(values, "\xff")] = counterValue{labels: values, value: value}
+	return nil
+}
+
+// delete removes the counters for the device with ip.
+func (c *counterVec) delete(ip string) {
+	i := sort.SearchStrings(c.names, "ip")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.values {
+		if v.labels[i] == ip {
+			delete(c.values, k)
+		}
+	}
+}
+
+func (c *counterVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *counterVec) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, v := range c.values {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, v.value, v.labels...)
+	}
+}
+
+// ServeMetrics exposes the default prometheus registry on /metrics at addr
+// until stop is closed, along with the health endpoints when health is set.
+func ServeMetrics(wg *sync.WaitGroup, stop chan bool, addr string, health bool) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if health {
+		handleHealth(mux)
+	}
+	serve(wg, stop, addr, "metrics", mux)
+}
+
+// serve runs an HTTP server for mux on addr until stop is closed, stopping
+// the daemon if it fails.
+func serve(wg *sync.WaitGroup, stop chan bool, addr string, name string, mux *http.ServeMux) {
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("%s server on %s failed: %s", name, addr, err)
+			Stop(stop)
+		}
+	}()
+	log.Infof("serving %s on %s", name, addr)
+
+	<-stop
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warningf("error shutting down %s server: %s", name, err)
+	}
+	log.Infof("stopping %s server", name)
+	wg.Done()
+}
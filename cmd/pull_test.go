@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+)
+
+func TestGaugeSetTypes(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	g := newGaugeSet(reg)
+	c := client{d: Device{Ip: "192.168.1.2", Name: "fridge"}}
+	g.set(c.timeSeries(energyMetric, 100, 1669888800000))
+	g.set(c.timeSeries(collectionErrorsMetric, 2, 1669888800000))
+	g.set(c.timeSeries(currentPowerMetric, 12345, 1669888800000))
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]dto.MetricType{
+		energyMetric.fullName():           dto.MetricType_COUNTER,
+		collectionErrorsMetric.fullName(): dto.MetricType_COUNTER,
+		currentPowerMetric.fullName():     dto.MetricType_GAUGE,
+	}
+	for _, f := range families {
+		if f.GetType() != want[f.GetName()] {
+			t.Errorf("got %s of type %s, want %s", f.GetName(), f.GetType(), want[f.GetName()])
+		}
+		delete(want, f.GetName())
+	}
+	for name := range want {
+		t.Errorf("missing %s", name)
+	}
+
+	g.delete("192.168.1.2")
+	if families, err = reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if len(f.GetMetric()) > 0 {
+			t.Errorf("got %s for a deleted device", f.GetName())
+		}
+	}
+}
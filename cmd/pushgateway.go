@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/prometheus/prompb"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+type (
+	// pushgatewayWriter is a Writer pushing the latest value of each metric
+	// to a Prometheus Pushgateway, grouped by device ip.
+	pushgatewayWriter struct {
+		url      string
+		job      string
+		grouping map[string]string
+		username string
+		password string
+		client   *http.Client
+	}
+	// pushedGauge is the latest value of a time-series pushed as a gauge.
+	pushedGauge struct {
+		labels prometheus.Labels
+		value  float64
+	}
+)
+
+func newPushgatewayWriter(conf Config) (*pushgatewayWriter, error) {
+	if _, err := url.Parse(conf.Pushgateway.URL); err != nil {
+		return nil, fmt.Errorf("cannot parse Pushgateway url: %w", err)
+	}
+	return &pushgatewayWriter{
+		url:      conf.Pushgateway.URL,
+		job:      conf.Pushgateway.Job,
+		grouping: conf.Pushgateway.Grouping,
+		username: conf.Pushgateway.Username,
+		password: conf.Pushgateway.Password,
+		client:   newHTTPClient(conf),
+	}, nil
+}
+
+// Write pushes a gauge for each metric in tss to the group for each device,
+// replacing metrics of the same name. The Pushgateway keeps a single value
+// per metric so only the latest sample is pushed.
+func (w *pushgatewayWriter) Write(ctx context.Context, tss []prompb.TimeSeries) error {
+	var urlErr *url.Error
+
+	// latest value by ip, metric and label set, so that the series of each
+	// channel are kept apart
+	latest := make(map[string]map[string]map[string]pushedGauge)
+	for _, ts := range tss {
+		var ip, metric string
+
+		if len(ts.Samples) == 0 {
+			continue
+		}
+		// ip groups the push so is not a label of the gauge
+		labels := make(prometheus.Labels)
+		for _, l := range ts.Labels {
+			switch l.Name {
+			case "__name__":
+				metric = l.Value
+			case "ip":
+				ip = l.Value
+			default:
+				labels[l.Name] = l.Value
+			}
+		}
+		if latest[ip] == nil {
+			latest[ip] = make(map[string]map[string]pushedGauge)
+		}
+		if latest[ip][metric] == nil {
+			latest[ip][metric] = make(map[string]pushedGauge)
+		}
+		latest[ip][metric][seriesKey(ts.Labels)] = pushedGauge{labels: labels, value: ts.Samples[len(ts.Samples)-1].Value}
+	}
+
+	ips := make([]string, 0, len(latest))
+	for ip := range latest {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		reg := prometheus.NewRegistry()
+		for metric, gauges := range latest[ip] {
+			names := gaugeLabelNames(gauges)
+			g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: metric, Help: metric + " reported by the device."}, names)
+			if err := reg.Register(g); err != nil {
+				return fmt.Errorf("%w: %s", errMarshal, err)
+			}
+			for _, pg := range gauges {
+				// series without a label of another, such as a channel,
+				// have it empty
+				for _, n := range names {
+					if _, ok := pg.labels[n]; !ok {
+						pg.labels[n] = ""
+					}
+				}
+				g.With(pg.labels).Set(pg.value)
+			}
+		}
+		p := push.New(w.url, w.job).Client(w.client).Gatherer(reg).Grouping("ip", ip)
+		for name, value := range w.grouping {
+			p = p.Grouping(name, value)
+		}
+		if w.username != "" || w.password != "" {
+			p = p.BasicAuth(w.username, w.password)
+		}
+		if err := p.AddContext(ctx); err != nil {
+			// the Pushgateway being unreachable may be temporary, a rejected
+			// push is not
+			if errors.As(err, &urlErr) {
+				return recoverableError{err}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// gaugeLabelNames returns the names of the labels of any of gauges, sorted.
+func gaugeLabelNames(gauges map[string]pushedGauge) []string {
+	var names []string
+
+	seen := make(map[string]bool)
+	for _, pg := range gauges {
+		for n := range pg.labels {
+			if !seen[n] {
+				seen[n] = true
+				names = append(names, n)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"context"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPushgatewayWriteChannels(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			var f dto.MetricFamily
+			if err := dec.Decode(&f); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Error(err)
+				break
+			}
+			for _, m := range f.GetMetric() {
+				var labels []string
+				for _, l := range m.GetLabel() {
+					labels = append(labels, l.GetName()+"="+l.GetValue())
+				}
+				got = append(got, r.URL.Path+" "+f.GetName()+"{"+strings.Join(labels, ",")+"}")
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	conf := Config{}
+	conf.Pushgateway.URL, conf.Pushgateway.Job = srv.URL, "tapmon"
+	w, err := newPushgatewayWriter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := client{d: Device{Ip: "192.168.1.2", Name: "meter"}}
+	tss := []prompb.TimeSeries{
+		c.timeSeries(currentPowerMetric, 1, 1669888800000, prompb.Label{Name: "channel", Value: "0"}),
+		c.timeSeries(currentPowerMetric, 2, 1669888800000, prompb.Label{Name: "channel", Value: "1"}),
+		c.timeSeries(upMetric, 1, 1669888800000),
+	}
+	if err = w.Write(context.Background(), tss); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(got)
+	want := []string{
+		"/metrics/job/tapmon/ip/192.168.1.2 current_power{channel=0,name=meter}",
+		"/metrics/job/tapmon/ip/192.168.1.2 current_power{channel=1,name=meter}",
+		"/metrics/job/tapmon/ip/192.168.1.2 up{name=meter}",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got pushed\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+type (
+	// remoteWriter is a Writer using Prometheus remote write.
+	remoteWriter struct {
+		c              remote.WriteClient
+		externalLabels []prompb.Label
+		relabelConfigs []*relabel.Config
+		compress       bool
+	}
+	// uncompressedTransport removes the snappy Content-Encoding header the
+	// remote write client always sets, for requests sent uncompressed.
+	uncompressedTransport struct {
+		next http.RoundTripper
+	}
+)
+
+const (
+	CompressionSnappy = "snappy"
+	CompressionNone   = "none"
+)
+
+func newRemoteWriter(conf Config) (*remoteWriter, error) {
+	var err error
+	var endpoint *url.URL
+	var httpConf config.HTTPClientConfig
+	var c remote.WriteClient
+
+	if endpoint, err = url.Parse(conf.Prometheus.Endpoint); err != nil {
+		return nil, fmt.Errorf("cannot parse endpoint url: %w", err)
+	}
+	if httpConf, err = httpClientConfig(conf); err != nil {
+		return nil, fmt.Errorf("invalid Prometheus config: %w", err)
+	}
+	c, err = remote.NewWriteClient(
+		conf.Prometheus.ClientName,
+		&remote.ClientConfig{
+			URL:              &config.URL{URL: endpoint},
+			Timeout:          model.Duration(writeTimeout),
+			HTTPClientConfig: httpConf,
+			Headers:          conf.Prometheus.Headers,
+			RetryOnRateLimit: true,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	w := &remoteWriter{c: c, compress: conf.Prometheus.Compression != CompressionNone}
+	if w.relabelConfigs, err = writeRelabelConfigs(conf); err != nil {
+		return nil, fmt.Errorf("invalid Prometheus.WriteRelabelConfigs: %w", err)
+	}
+	rc, ok := c.(*remote.Client)
+	if !ok {
+		return nil, errors.New("remote write client does not support setting its transport")
+	}
+	rc.Client.Transport = userAgentTransport{agent: conf.UserAgent, next: rc.Client.Transport}
+	if !w.compress {
+		rc.Client.Transport = uncompressedTransport{next: rc.Client.Transport}
+	}
+	for name, value := range conf.Prometheus.ExternalLabels {
+		w.externalLabels = append(w.externalLabels, prompb.Label{Name: name, Value: value})
+	}
+	sortLabels(w.externalLabels)
+	return w, nil
+}
+
+// Write merges the samples of each series in tss then marshals and, unless
+// compression is disabled, snappy encodes tss into a WriteRequest and pushes
+// it to the remote write endpoint.
+func (w *remoteWriter) Write(ctx context.Context, tss []prompb.TimeSeries) error {
+	var recoverable remote.RecoverableError
+
+	data, err := proto.Marshal(&prompb.WriteRequest{Timeseries: mergeSeries(w.relabel(w.withExternalLabels(tss)))})
+	if err != nil {
+		return fmt.Errorf("%w: %s", errMarshal, err)
+	}
+	if w.compress {
+		data = snappy.Encode(nil, data)
+	}
+	if err = w.c.Store(ctx, data); err != nil {
+		if errors.As(err, &recoverable) {
+			return recoverableError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// withExternalLabels returns a copy of tss with the external labels added to
+// each time-series, labels already set on a time-series take precedence.
+func (w *remoteWriter) withExternalLabels(tss []prompb.TimeSeries) []prompb.TimeSeries {
+	if len(w.externalLabels) == 0 {
+		return tss
+	}
+	out := make([]prompb.TimeSeries, len(tss))
+	for i, ts := range tss {
+		labels := make([]prompb.Label, len(ts.Labels), len(ts.Labels)+len(w.externalLabels))
+		copy(labels, ts.Labels)
+	external:
+		for _, el := range w.externalLabels {
+			for _, l := range ts.Labels {
+				if l.Name == el.Name {
+					continue external
+				}
+			}
+			labels = append(labels, el)
+		}
+		out[i] = prompb.TimeSeries{Labels: sortLabels(labels), Samples: ts.Samples}
+	}
+	return out
+}
+
+// relabel applies the write relabel configs to tss, omitting any time-series
+// they drop.
+func (w *remoteWriter) relabel(tss []prompb.TimeSeries) []prompb.TimeSeries {
+	if len(w.relabelConfigs) == 0 {
+		return tss
+	}
+	out := make([]prompb.TimeSeries, 0, len(tss))
+	for _, ts := range tss {
+		ls := make(labels.Labels, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			ls = append(ls, labels.Label{Name: l.Name, Value: l.Value})
+		}
+		if ls = relabel.Process(labels.New(ls...), w.relabelConfigs...); ls == nil {
+			continue
+		}
+		relabelled := make([]prompb.Label, 0, len(ls))
+		for _, l := range ls {
+			relabelled = append(relabelled, prompb.Label{Name: l.Name, Value: l.Value})
+		}
+		out = append(out, prompb.TimeSeries{Labels: relabelled, Samples: ts.Samples})
+	}
+	return out
+}
+
+// mergeSeries returns tss with the samples of time-series having the same
+// labels combined into one time-series, in order of first appearance. Samples
+// are sorted by timestamp with only the last of any with the same timestamp
+// kept, as remote write rejects out of order and duplicate samples.
+func mergeSeries(tss []prompb.TimeSeries) []prompb.TimeSeries {
+	var out []prompb.TimeSeries
+	index := make(map[string]int)
+
+	for _, ts := range tss {
+		key := seriesKey(ts.Labels)
+		i, ok := index[key]
+		if !ok {
+			i = len(out)
+			index[key] = i
+			out = append(out, prompb.TimeSeries{Labels: ts.Labels})
+		}
+		out[i].Samples = append(out[i].Samples, ts.Samples...)
+	}
+	for i := range out {
+		samples := out[i].Samples
+		sort.SliceStable(samples, func(a, b int) bool {
+			return samples[a].Timestamp < samples[b].Timestamp
+		})
+		deduped := samples[:0]
+		for _, s := range samples {
+			if n := len(deduped); n > 0 && deduped[n-1].Timestamp == s.Timestamp {
+				deduped[n-1] = s
+				continue
+			}
+			deduped = append(deduped, s)
+		}
+		out[i].Samples = deduped
+	}
+	return out
+}
+
+// seriesKey identifies a time-series by its labels regardless of their order.
+func seriesKey(ls []prompb.Label) string {
+	var b strings.Builder
+
+	sorted := append([]prompb.Label(nil), ls...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	for _, l := range sorted {
+		b.WriteString(l.Name)
+		b.WriteByte(0)
+		b.WriteString(l.Value)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func (t uncompressedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Del("Content-Encoding")
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"context"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type (
+	// remoteWriteReceiver is a remote write endpoint recording the
+	// time-series written to it.
+	remoteWriteReceiver struct {
+		*httptest.Server
+		mu  sync.Mutex
+		tss []prompb.TimeSeries
+		// hosts are the hosts requested, of the endpoint when proxying
+		hosts []string
+	}
+)
+
+func newRemoteWriteReceiver(t *testing.T) *remoteWriteReceiver {
+	r := &remoteWriteReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var wr prompb.WriteRequest
+
+		b, err := io.ReadAll(req.Body)
+		if err == nil {
+			b, err = snappy.Decode(nil, b)
+		}
+		if err == nil {
+			err = proto.Unmarshal(b, &wr)
+		}
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		r.tss = append(r.tss, wr.Timeseries...)
+		r.hosts = append(r.hosts, req.Host)
+		r.mu.Unlock()
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// written returns the time-series written so far.
+func (r *remoteWriteReceiver) written() []prompb.TimeSeries {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]prompb.TimeSeries(nil), r.tss...)
+}
+
+// interleaved returns the time-series of two devices polled in turn, as
+// batched by WriteMetrics, with a late and a repeated sample of the first.
+func interleaved() []prompb.TimeSeries {
+	fridge := client{d: Device{Ip: "192.168.1.2", Name: "fridge"}}
+	kettle := client{d: Device{Ip: "192.168.1.3", Name: "kettle"}}
+	return []prompb.TimeSeries{
+		fridge.timeSeries(currentPowerMetric, 10, 1000),
+		kettle.timeSeries(currentPowerMetric, 20, 1500),
+		fridge.timeSeries(currentPowerMetric, 30, 3000),
+		kettle.timeSeries(currentPowerMetric, 40, 2500),
+		fridge.timeSeries(currentPowerMetric, 50, 2000),
+		fridge.timeSeries(currentPowerMetric, 60, 3000),
+		kettle.timeSeries(deviceOnMetric, 1, 2500),
+	}
+}
+
+func TestMergeSeries(t *testing.T) {
+	tss := interleaved()
+	want := []prompb.TimeSeries{
+		{Labels: tss[0].Labels, Samples: []prompb.Sample{{Value: 10, Timestamp: 1000}, {Value: 50, Timestamp: 2000}, {Value: 60, Timestamp: 3000}}},
+		{Labels: tss[1].Labels, Samples: []prompb.Sample{{Value: 20, Timestamp: 1500}, {Value: 40, Timestamp: 2500}}},
+		{Labels: tss[6].Labels, Samples: []prompb.Sample{{Value: 1, Timestamp: 2500}}},
+	}
+
+	got := mergeSeries(tss)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, ts := range got {
+		for i := 1; i < len(ts.Samples); i++ {
+			if ts.Samples[i].Timestamp <= ts.Samples[i-1].Timestamp {
+				t.Errorf("got timestamps %v of %v out of order", ts.Samples, ts.Labels)
+			}
+		}
+	}
+}
+
+func TestRemoteWriteLabels(t *testing.T) {
+	r := newRemoteWriteReceiver(t)
+	conf := Config{}
+	conf.Prometheus.Endpoint = r.URL
+	// Zone sorts before __name__, site after
+	conf.Prometheus.ExternalLabels = map[string]string{"Zone": "eu", "site": "home"}
+	conf.Prometheus.WriteRelabelConfigs = []map[string]interface{}{
+		{"source_labels": []string{"name"}, "target_label": "appliance"},
+		{"action": "labeldrop", "regex": "ip"},
+	}
+	w, err := newRemoteWriter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Write(context.Background(), interleaved()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := r.written()
+	if len(got) != 3 {
+		t.Fatalf("got %d time-series, want 3", len(got))
+	}
+	for _, ts := range got {
+		if !sort.SliceIsSorted(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name }) {
+			t.Errorf("got unsorted labels %v", ts.Labels)
+		}
+		labels := make(map[string]string)
+		for _, l := range ts.Labels {
+			labels[l.Name] = l.Value
+		}
+		for _, name := range []string{"__name__", "Zone", "site", "appliance"} {
+			if labels[name] == "" {
+				t.Errorf("missing %s in %v", name, ts.Labels)
+			}
+		}
+		if _, ok := labels["ip"]; ok {
+			t.Errorf("got dropped label ip in %v", ts.Labels)
+		}
+	}
+}
+
+func TestRemoteWriteProxy(t *testing.T) {
+	// the proxy receives the write for an endpoint that cannot be resolved
+	proxy := newRemoteWriteReceiver(t)
+	conf := Config{}
+	conf.Prometheus.Endpoint = "http://remote-write.invalid/api/v1/write"
+	conf.Prometheus.ProxyURL = proxy.URL
+	w, err := newRemoteWriter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Write(context.Background(), interleaved()); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(proxy.written()); got != 3 {
+		t.Errorf("got %d time-series through the proxy, want 3", got)
+	}
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if want := []string{"remote-write.invalid"}; !reflect.DeepEqual(proxy.hosts, want) {
+		t.Errorf("got requests for %v through the proxy, want %v", proxy.hosts, want)
+	}
+}
+
+func TestRemoteWriteInvalidProxy(t *testing.T) {
+	for _, tc := range []struct {
+		proxy string
+		want  string
+	}{
+		{proxy: "ftp://proxy:21", want: `unsupported proxy scheme "ftp"`},
+		{proxy: "http://[::1", want: "missing ']' in host"},
+	} {
+		conf := Config{}
+		conf.Prometheus.Endpoint = "http://localhost:9090/api/v1/write"
+		conf.Prometheus.ProxyURL = tc.proxy
+		if _, err := newRemoteWriter(conf); err == nil || !strings.Contains(err.Error(), "invalid ProxyURL") || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("got error %v for proxy %s, want %s", err, tc.proxy, tc.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"time"
+)
+
+var setCmd = &cobra.Command{
+	Use:   "set [config] <device> on|off",
+	Short: "Switch devices on or off",
+	Long: `Switch devices on or off. The device is selected by ip or name from the config,
+or * to select all devices. With --group the device is omitted and the devices in
+the group are selected.`,
+	Args:              setArgs,
+	ValidArgsFunction: completeSet,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var conf Config
+		var config string
+		var path string
+		var devices []Device
+		var c client
+		var r map[string]interface{}
+		var failed bool
+		var err error
+
+		group, _ := cmd.Flags().GetString("group")
+		state := args[len(args)-1]
+		// the group selects the devices in place of the device argument
+		selector, n := "*", 1
+		if group == "" {
+			selector, n = args[len(args)-2], 2
+		}
+		if len(args) > n {
+			config = args[0]
+		}
+		if state != "on" && state != "off" {
+			return fmt.Errorf("state must be on or off, not %s", state)
+		}
+		if path, err = configFile(cmd, config); err != nil {
+			return err
+		}
+		viper.SetConfigFile(path)
+		if conf, err = loadConfig(); err != nil {
+			return err
+		}
+		setCollection(conf)
+		if devices = selectDevices(conf.Devices, selector, group); len(devices) == 0 {
+			if group != "" {
+				return fmt.Errorf("no devices in group %s", group)
+			}
+			return fmt.Errorf("no devices match %s", selector)
+		}
+
+		for _, d := range devices {
+			if c, err = connectWithin(d, time.Duration(conf.ConnectTimeout)*time.Second); err != nil {
+				fmt.Printf("FAIL %s: could not connect: %s\n", deviceString(d), err)
+				failed = true
+				continue
+			}
+			if state == "on" {
+				r, err = c.call(c.t.TurnOn)
+			} else {
+				r, err = c.call(c.t.TurnOff)
+			}
+			if err == nil && r["error_code"] != float64(0) {
+				err = fmt.Errorf("error code %v", r["error_code"])
+			}
+			if err != nil {
+				fmt.Printf("FAIL %s: could not switch %s: %s\n", deviceString(d), state, err)
+				failed = true
+				continue
+			}
+			fmt.Printf("%s: %s\n", deviceString(d), deviceState(c))
+		}
+
+		if failed {
+			return errors.New("one or more devices could not be switched")
+		}
+		return nil
+	},
+}
+
+// setArgs validates the arguments of set, which takes no device argument
+// when given --group.
+func setArgs(cmd *cobra.Command, args []string) error {
+	if group, _ := cmd.Flags().GetString("group"); group != "" {
+		return cobra.RangeArgs(1, 2)(cmd, args)
+	}
+	return cobra.RangeArgs(2, 3)(cmd, args)
+}
+
+// selectDevices returns the devices matching selector by ip or name, or all
+// devices when selector is *, that are also in group when group is set.
+func selectDevices(devices []Device, selector string, group string) []Device {
+	var selected []Device
+	for _, d := range devices {
+		if group != "" && d.Group != group {
+			continue
+		}
+		if selector == "*" || d.Ip == selector || (d.Name != "" && d.Name == selector) {
+			selected = append(selected, d)
+		}
+	}
+	return selected
+}
+
+// deviceState returns on or off as reported by the device, or unknown if the
+// state could not be read.
+func deviceState(c client) string {
+	r, err := c.call(c.t.DeviceInfo)
+	if err != nil {
+		return "unknown"
+	}
+	result, _ := r["result"].(map[string]interface{})
+	on, ok := result["device_on"].(bool)
+	switch {
+	case !ok:
+		return "unknown"
+	case on:
+		return "on"
+	}
+	return "off"
+}
+
+func init() {
+	setCmd.Flags().String("group", "", "switch the devices in group rather than a device given as an argument")
+	daemonCmd.AddCommand(setCmd)
+}
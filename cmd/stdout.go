@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"time"
+)
+
+type (
+	// stdoutWriter is a Writer printing each sample as a line of JSON.
+	stdoutWriter struct {
+		enc *json.Encoder
+	}
+	sample struct {
+		Timestamp string  `json:"timestamp"`
+		Ip        string  `json:"ip"`
+		Name      string  `json:"name"`
+		Channel   string  `json:"channel,omitempty"`
+		Nickname  string  `json:"nickname,omitempty"`
+		Metric    string  `json:"metric"`
+		Value     float64 `json:"value"`
+	}
+)
+
+func newStdoutWriter(w io.Writer) *stdoutWriter {
+	return &stdoutWriter{enc: json.NewEncoder(w)}
+}
+
+func (w *stdoutWriter) Write(_ context.Context, tss []prompb.TimeSeries) error {
+	for _, s := range samples(tss) {
+		if err := w.enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// samples flattens tss into one sample per time-series sample.
+func samples(tss []prompb.TimeSeries) []sample {
+	var out []sample
+	for _, ts := range tss {
+		var s sample
+		for _, l := range ts.Labels {
+			switch l.Name {
+			case "__name__":
+				s.Metric = l.Value
+			case "ip":
+				s.Ip = l.Value
+			case "name":
+				s.Name = l.Value
+			case "channel":
+				s.Channel = l.Value
+			case "nickname":
+				s.Nickname = l.Value
+			}
+		}
+		for _, v := range ts.Samples {
+			s.Timestamp = time.UnixMilli(v.Timestamp).UTC().Format(time.RFC3339Nano)
+			s.Value = v.Value
+			out = append(out, s)
+		}
+	}
+	return out
+}
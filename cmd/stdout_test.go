@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+	"reflect"
+	"testing"
+)
+
+func TestSamples(t *testing.T) {
+	c := client{d: Device{Ip: "192.168.1.2", Name: "meter"}}
+	tss := []prompb.TimeSeries{
+		c.timeSeries(currentPowerMetric, 12345, 1669888800000, prompb.Label{Name: "channel", Value: "1"}),
+		c.timeSeries(deviceInfoMetric, 1, 1669888800000, prompb.Label{Name: "nickname", Value: "Meter"}),
+	}
+	want := []sample{
+		{Timestamp: "2022-12-01T10:00:00Z", Ip: "192.168.1.2", Name: "meter", Channel: "1", Metric: currentPowerMetric.fullName(), Value: 12345},
+		{Timestamp: "2022-12-01T10:00:00Z", Ip: "192.168.1.2", Name: "meter", Nickname: "Meter", Metric: deviceInfoMetric.fullName(), Value: 1},
+	}
+	if got := samples(tss); !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %+v, want %+v", got, want)
+	}
+}
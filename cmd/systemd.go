@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"github.com/coreos/go-systemd/v22/daemon"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+// NotifySystemd reports to systemd, when run as a Type=notify service, that
+// tapmon is ready once a device has been read and every Writer created, and
+// that it is stopping once stop is closed. Watchdog keep-alives are sent at
+// half the WatchdogSec interval when one is configured.
+func NotifySystemd(wg *sync.WaitGroup, stop chan bool) {
+	var watchdog <-chan time.Time
+
+	defer wg.Done()
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	if interval, err := daemon.SdWatchdogEnabled(false); err != nil {
+		log.Warningf("could not read systemd watchdog interval: %s", err)
+	} else if interval > 0 {
+		t := time.NewTicker(interval / 2)
+		defer t.Stop()
+		watchdog = t.C
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for ready := false; ; {
+		select {
+		case <-stop:
+			sdNotify(daemon.SdNotifyStopping)
+			return
+		case <-ticker.C:
+			if !ready && readiness.ready() {
+				log.Info("notifying systemd that tapmon is ready")
+				sdNotify(daemon.SdNotifyReady)
+				ready = true
+			}
+		case <-watchdog:
+			sdNotify(daemon.SdNotifyWatchdog)
+		}
+	}
+}
+
+// sdNotify sends state to systemd, logging any failure.
+func sdNotify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		log.Warningf("could not notify systemd of %s: %s", state, err)
+	}
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"time"
+)
+
+var testCmd = &cobra.Command{
+	Use:               "test [config]",
+	Short:             "Validate config and check connectivity to devices and the output",
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: completeConfig,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var conf Config
+		var path string
+		var c client
+		var devices []Device
+		var tss []prompb.TimeSeries
+		var failed bool
+		var err error
+
+		if path, err = configFile(cmd, firstArg(args)); err != nil {
+			return err
+		}
+		viper.SetConfigFile(path)
+		if conf, err = loadConfig(); err != nil {
+			return err
+		}
+		fmt.Println("config ok")
+		metricNamespace = conf.Prometheus.Namespace
+		setCollection(conf)
+
+		group, _ := cmd.Flags().GetString("group")
+		if devices = selectDevices(conf.Devices, "*", group); len(devices) == 0 {
+			return fmt.Errorf("no devices in group %s", group)
+		}
+		for _, d := range devices {
+			if c, err = connectWithin(d, time.Duration(conf.ConnectTimeout)*time.Second); err != nil {
+				fmt.Printf("FAIL %s: could not connect: %s\n", deviceString(d), err)
+				failed = true
+				continue
+			}
+			if tss, err = collect(c, time.Now()); err != nil {
+				fmt.Printf("FAIL %s: could not collect energy usage: %s\n", deviceString(d), err)
+				failed = true
+				continue
+			}
+			// current_power is only collected when the Power metrics are enabled
+			power := ""
+			for _, s := range samples(tss) {
+				if s.Metric == currentPowerMetric.fullName() {
+					power = fmt.Sprintf(": current_power %g", s.Value)
+				}
+			}
+			fmt.Printf("ok   %s%s\n", deviceString(d), power)
+		}
+
+		if conf.push() {
+			for _, out := range conf.outputs() {
+				if _, err = newWriter(out); err != nil {
+					fmt.Printf("FAIL %s output: %s\n", outputString(out), err)
+					failed = true
+				} else if ping, _ := cmd.Flags().GetBool("ping"); ping && out.Output != OutputStdout {
+					if err = checkOutput(out); err != nil {
+						fmt.Printf("FAIL %s output: %s\n", outputString(out), err)
+						failed = true
+					} else {
+						fmt.Printf("ok   %s output\n", outputString(out))
+					}
+				} else {
+					fmt.Printf("ok   %s output created\n", outputString(out))
+				}
+			}
+		}
+
+		if failed {
+			return errors.New("one or more checks failed")
+		}
+		return nil
+	},
+}
+
+// deviceString identifies d by ip and, when configured, name.
+func deviceString(d Device) string {
+	if d.Name != "" {
+		return fmt.Sprintf("%s (%s)", d.Ip, d.Name)
+	}
+	return d.Ip
+}
+
+func init() {
+	testCmd.Flags().Bool("ping", false, "send an empty write to the output to check it is reachable")
+	testCmd.Flags().String("group", "", "only check the devices in group")
+	daemonCmd.AddCommand(testCmd)
+}
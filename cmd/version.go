@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"runtime"
+)
+
+// set at build time using -ldflags "-X github.com/richardjennings/tapmon/cmd.version=..."
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the version of tapmon",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("tapmon %s\ncommit: %s\nbuilt: %s\ngo: %s\n", version, commit, date, runtime.Version())
+	},
+}
+
+func init() {
+	daemonCmd.AddCommand(versionCmd)
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	VictoriaMetricsJSON       = "json"
+	VictoriaMetricsPrometheus = "prometheus"
+)
+
+var victoriaMetricsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+type (
+	// victoriaMetricsWriter is a Writer posting to the VictoriaMetrics JSON
+	// line or Prometheus text import API.
+	victoriaMetricsWriter struct {
+		url    string
+		format string
+		client *http.Client
+	}
+	// victoriaMetricsLine is a line of the JSON line import format.
+	victoriaMetricsLine struct {
+		Metric     map[string]string `json:"metric"`
+		Values     []float64         `json:"values"`
+		Timestamps []int64           `json:"timestamps"`
+	}
+)
+
+func newVictoriaMetricsWriter(conf Config) (*victoriaMetricsWriter, error) {
+	var httpConf config.HTTPClientConfig
+	var c *http.Client
+
+	v := conf.VictoriaMetrics
+	u, err := url.Parse(v.URL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse VictoriaMetrics url: %w", err)
+	}
+	u = u.JoinPath("/api/v1/import")
+	if v.Format == VictoriaMetricsPrometheus {
+		u = u.JoinPath("prometheus")
+	}
+	if httpConf, err = newHTTPClientConfig(v.Username, v.Password, v.BearerToken, v.BearerTokenFile, v.TLS); err != nil {
+		return nil, fmt.Errorf("invalid VictoriaMetrics config: %w", err)
+	}
+	if c, err = config.NewClientFromConfig(httpConf, "tapmon"); err != nil {
+		return nil, err
+	}
+	c.Timeout = writeTimeout
+	c.Transport = userAgentTransport{agent: conf.UserAgent, next: c.Transport}
+	return &victoriaMetricsWriter{url: u.String(), format: v.Format, client: c}, nil
+}
+
+// Write posts tss in the configured import format. Staleness markers are
+// skipped as neither format can carry them.
+func (w *victoriaMetricsWriter) Write(ctx context.Context, tss []prompb.TimeSeries) error {
+	var buf bytes.Buffer
+	var req *http.Request
+	var res *http.Response
+	var err error
+
+	for _, ts := range tss {
+		if w.format == VictoriaMetricsPrometheus {
+			writeExpositionLines(&buf, ts)
+		} else if err = writeJSONLine(&buf, ts); err != nil {
+			return fmt.Errorf("%w: %s", errMarshal, err)
+		}
+	}
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, w.url, &buf); err != nil {
+		return err
+	}
+	if w.format == VictoriaMetricsPrometheus {
+		req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if res, err = w.client.Do(req); err != nil {
+		return recoverableError{err}
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	switch {
+	case res.StatusCode/100 == 2:
+		return nil
+	case res.StatusCode/100 == 5 || res.StatusCode == http.StatusTooManyRequests:
+		return recoverableError{fmt.Errorf("server returned HTTP status %s: %s", res.Status, body)}
+	}
+	return fmt.Errorf("server returned HTTP status %s: %s", res.Status, body)
+}
+
+// writeJSONLine appends ts to buf as a line of the JSON line import format,
+// writing nothing if ts has only staleness markers.
+func writeJSONLine(buf *bytes.Buffer, ts prompb.TimeSeries) error {
+	line := victoriaMetricsLine{Metric: make(map[string]string, len(ts.Labels))}
+	for _, l := range ts.Labels {
+		if l.Value != "" {
+			line.Metric[l.Name] = l.Value
+		}
+	}
+	for _, s := range ts.Samples {
+		if value.IsStaleNaN(s.Value) {
+			continue
+		}
+		line.Values = append(line.Values, s.Value)
+		line.Timestamps = append(line.Timestamps, s.Timestamp)
+	}
+	if len(line.Values) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	buf.WriteString("\n")
+	return nil
+}
+
+// writeExpositionLines appends a line of the Prometheus text format for each
+// sample in ts to buf, with millisecond timestamps.
+func writeExpositionLines(buf *bytes.Buffer, ts prompb.TimeSeries) {
+	var name string
+	var labels []string
+
+	for _, l := range ts.Labels {
+		switch {
+		case l.Name == "__name__":
+			name = l.Value
+		case l.Value != "":
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, l.Name, victoriaMetricsEscaper.Replace(l.Value)))
+		}
+	}
+	series := name
+	if len(labels) > 0 {
+		series += "{" + strings.Join(labels, ",") + "}"
+	}
+	for _, s := range ts.Samples {
+		if value.IsStaleNaN(s.Value) {
+			continue
+		}
+		buf.WriteString(series)
+		buf.WriteString(" ")
+		buf.WriteString(strconv.FormatFloat(s.Value, 'f', -1, 64))
+		buf.WriteString(" ")
+		buf.WriteString(strconv.FormatInt(s.Timestamp, 10))
+		buf.WriteString("\n")
+	}
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+type (
+	// webhookWriter is a Writer posting each batch as a JSON array of
+	// samples to an HTTP endpoint.
+	webhookWriter struct {
+		url      string
+		headers  map[string]string
+		username string
+		password string
+		client   *http.Client
+	}
+)
+
+func newWebhookWriter(conf Config) (*webhookWriter, error) {
+	if _, err := url.Parse(conf.Webhook.URL); err != nil {
+		return nil, fmt.Errorf("cannot parse Webhook url: %w", err)
+	}
+	return &webhookWriter{
+		url:      conf.Webhook.URL,
+		headers:  conf.Webhook.Headers,
+		username: conf.Webhook.Username,
+		password: conf.Webhook.Password,
+		client:   newHTTPClient(conf),
+	}, nil
+}
+
+// Write posts tss as a JSON array with an element per sample, in the same
+// format as the stdout output. Any response other than 2xx is recoverable.
+func (w *webhookWriter) Write(ctx context.Context, tss []prompb.TimeSeries) error {
+	var body []byte
+	var req *http.Request
+	var res *http.Response
+	var err error
+
+	// an empty batch is posted as [] rather than null
+	ss := append([]sample{}, samples(tss)...)
+	if body, err = json.Marshal(ss); err != nil {
+		return fmt.Errorf("%w: %s", errMarshal, err)
+	}
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body)); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	if w.username != "" || w.password != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+	if res, err = w.client.Do(req); err != nil {
+		return recoverableError{err}
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	if res.StatusCode/100 != 2 {
+		return recoverableError{fmt.Errorf("server returned HTTP status %s: %s", res.Status, msg)}
+	}
+	return nil
+}
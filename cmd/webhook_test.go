@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/prometheus/prometheus/prompb"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookRetriesClientErrors(t *testing.T) {
+	var mu sync.Mutex
+	var posted [][]sample
+
+	statuses := []int{http.StatusBadRequest, http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ss []sample
+		if err := json.NewDecoder(r.Body).Decode(&ss); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		posted = append(posted, ss)
+		w.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer srv.Close()
+
+	conf := Config{}
+	conf.Webhook.URL = srv.URL
+	w, err := newWebhookWriter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := newFakeClock(time.Unix(1669888800, 0))
+	c := client{d: Device{Ip: "192.168.1.2", Name: "fridge"}}
+	p := retryPolicy{clk: clk, retries: 1, initial: time.Second, max: time.Second}
+	if err = store(w, []prompb.TimeSeries{c.timeSeries(currentPowerMetric, 12345, clk.Now().UnixMilli())}, p, testStorage()); err != nil {
+		t.Fatalf("got error %v after a 400 then 200", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posted) != 2 {
+		t.Fatalf("got %d posts, want 2", len(posted))
+	}
+	for _, ss := range posted {
+		if len(ss) != 1 || ss[0].Value != 12345 {
+			t.Errorf("got posted %+v", ss)
+		}
+	}
+	if len(clk.sleeps()) != 1 {
+		t.Errorf("got sleeps %v, want 1 backoff", clk.sleeps())
+	}
+}
@@ -0,0 +1,460 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// storeJitter is the fraction by which each store retry delay is randomly
+	// adjusted.
+	storeJitter = 0.2
+	// maxStoreFailures is the number of consecutive flushes failing with an
+	// irrecoverable error after which the daemon is stopped.
+	maxStoreFailures = 5
+	// writeTimeout bounds each attempt to write a batch to the output.
+	writeTimeout = 30 * time.Second
+)
+
+const (
+	OutputPrometheus      = "prometheus"
+	OutputInfluxDB        = "influxdb"
+	OutputOTLP            = "otlp"
+	OutputStdout          = "stdout"
+	OutputPushgateway     = "pushgateway"
+	OutputMQTT            = "mqtt"
+	OutputWebhook         = "webhook"
+	OutputCSV             = "csv"
+	OutputVictoriaMetrics = "victoriametrics"
+	OutputDatadog         = "datadog"
+	OutputKafka           = "kafka"
+)
+
+type (
+	// Writer pushes a batch of time-series to an output backend.
+	Writer interface {
+		Write(ctx context.Context, tss []prompb.TimeSeries) error
+	}
+	// userAgentTransport sets the User-Agent header of each request,
+	// replacing any set by the client.
+	userAgentTransport struct {
+		agent string
+		next  http.RoundTripper
+	}
+	// recoverableError marks Writer errors that may succeed if retried.
+	recoverableError struct {
+		error
+	}
+	// retryPolicy controls how recoverable store errors are retried within a
+	// single flush, timed by clk.
+	retryPolicy struct {
+		clk     clock
+		retries int
+		initial time.Duration
+		max     time.Duration
+		// deadline bounds all attempts when set, as for the final flush
+		deadline time.Time
+	}
+)
+
+// errMarshal is returned by a Writer when a batch cannot be marshalled.
+var errMarshal = errors.New("unable to marshal protobuf")
+
+// writeSlots bounds the number of write requests in flight across all
+// outputs, set from Prometheus.MaxConcurrentWrites.
+var writeSlots = make(chan struct{}, 4)
+
+func (e recoverableError) Unwrap() error {
+	return e.error
+}
+
+func isRecoverable(err error) bool {
+	return errors.As(err, &recoverableError{})
+}
+
+// newHTTPClient returns the client used by HTTP based Writers, identifying
+// requests with the configured UserAgent.
+func newHTTPClient(conf Config) *http.Client {
+	return &http.Client{
+		Timeout:   writeTimeout,
+		Transport: userAgentTransport{agent: conf.UserAgent, next: http.DefaultTransport},
+	}
+}
+
+// newWriter returns the Writer for the configured Output.
+func newWriter(conf Config) (Writer, error) {
+	if conf.dryRun {
+		return newDryRunWriter(conf), nil
+	}
+	switch conf.Output {
+	case OutputPrometheus:
+		return newRemoteWriter(conf)
+	case OutputInfluxDB:
+		return newInfluxWriter(conf)
+	case OutputOTLP:
+		return newOTLPWriter(conf)
+	case OutputStdout:
+		return newStdoutWriter(os.Stdout), nil
+	case OutputPushgateway:
+		return newPushgatewayWriter(conf)
+	case OutputMQTT:
+		return newMQTTWriter(conf)
+	case OutputWebhook:
+		return newWebhookWriter(conf)
+	case OutputCSV:
+		return newCSVWriter(conf)
+	case OutputVictoriaMetrics:
+		return newVictoriaMetricsWriter(conf)
+	case OutputDatadog:
+		return newDatadogWriter(conf)
+	case OutputKafka:
+		return newKafkaWriter(conf)
+	}
+	return nil, fmt.Errorf("unknown Output %s", conf.Output)
+}
+
+// checkOutput creates the Writer for conf and makes an empty write to check
+// the output is reachable and accepts writes.
+func checkOutput(conf Config) error {
+	w, err := newWriter(conf)
+	if err != nil {
+		return err
+	}
+	return write(w, nil, writeTimeout)
+}
+
+// WriteMetrics batches time-series received on metrics and pushes them using
+// the configured Writer every FlushInterval seconds. A config received on
+// reload replaces the Writer and retry policy from the next flush, keeping
+// the time-series not yet pushed. Batches failing with a
+// recoverable error are retained for the next flush, those failing with an
+// irrecoverable error are dropped and after maxStoreFailures consecutive
+// such failures the daemon is stopped. When Prometheus.Aggregation is set the
+// samples received in each flush interval are aggregated per series, once.
+func WriteMetrics(wg *sync.WaitGroup, stop chan bool, clk clock, metrics chan prompb.TimeSeries, reload chan Config, conf Config) {
+	writeMetrics(wg, stop, clk, metrics, reload, conf, newWriter)
+}
+
+// writeMetrics is WriteMetrics creating each Writer with create.
+func writeMetrics(wg *sync.WaitGroup, stop chan bool, clk clock, metrics chan prompb.TimeSeries, reload chan Config, conf Config, create func(Config) (Writer, error)) {
+	var ok bool
+	var ts prompb.TimeSeries
+	var err error
+	var w, next Writer
+	var failures int
+	var dropped uint64
+	var unsent []prompb.TimeSeries
+	// window holds the time-series received since the last flush, tss those
+	// retained from earlier flushes
+	var window []prompb.TimeSeries
+
+	defer wg.Done()
+	retries := newRetryPolicy(conf, clk)
+	rs := newRemoteStorage(conf)
+
+	if w, err = create(conf); err != nil {
+		log.Errorf("could not create %s writer, stopping: %s", conf.Output, err)
+		Stop(stop)
+		return
+	}
+	readiness.pendingWriters.Add(-1)
+
+	// offset start time by 1 second
+	clk.Sleep(time.Second)
+
+	ticker := clk.NewTicker(conf.Prometheus.FlushInterval.Duration())
+
+	buf := newDiskBuffer(conf.Prometheus.BufferPath, conf.Prometheus.BufferRetention)
+	tss := expire(buf.load(), buf, conf.Prometheus.MaxSampleAge, clk.Now(), rs)
+	if len(tss) > 0 {
+		log.Infof("replaying %d buffered timeseries", len(tss))
+	}
+	rs.pending.Set(float64(sampleCount(tss)))
+
+	for {
+		select {
+		case _, ok = <-stop:
+			if !ok {
+				ticker.Stop()
+				// drain anything the collectors managed to send before stopping
+				for drained := false; !drained; {
+					select {
+					case ts = <-metrics:
+						window = append(window, ts)
+					default:
+						drained = true
+					}
+				}
+				tss = batch(tss, window, buf, conf, clk.Now(), rs)
+				rs.pending.Set(float64(sampleCount(tss)))
+				if len(tss) > 0 {
+					timeout := time.Duration(conf.ShutdownTimeout) * time.Second
+					log.Infof("flushing %d timeseries before stopping, within %s", len(tss), timeout)
+					buf.save(tss)
+					retries.deadline = clk.Now().Add(timeout)
+					if unsent, err = storeChunks(w, tss, conf.Prometheus.MaxSamplesPerSend, retries, rs); err != nil {
+						buf.save(unsent)
+						sent := sampleCount(tss) - sampleCount(unsent)
+						if buf != nil {
+							log.Errorf("final flush failed, flushed %d samples and buffered %d to %s: %s", sent, sampleCount(unsent), buf.path, err)
+						} else {
+							log.Errorf("final flush failed, flushed %d samples and dropped %d: %s", sent, sampleCount(unsent), err)
+							rs.dropped.Add(float64(sampleCount(unsent)))
+						}
+					} else {
+						log.Infof("flushed %d samples, dropped 0", sampleCount(tss))
+						buf.save(nil)
+					}
+				}
+				log.Info("stopping WriteMetrics")
+				return
+			}
+
+		case ts = <-metrics:
+			log.Debug("received time-series")
+			window = append(window, ts)
+			rs.pending.Add(float64(len(ts.Samples)))
+
+		case c := <-reload:
+			if next, err = create(c); err != nil {
+				log.Errorf("could not create %s writer from reloaded config, keeping current writer: %s", outputString(c), err)
+				continue
+			}
+			log.Infof("reloaded %s writer, retaining %d timeseries", outputString(c), len(tss)+len(window))
+			w, conf = next, c
+			retries = newRetryPolicy(conf, clk)
+			rs.pending.Set(0)
+			rs = newRemoteStorage(conf)
+			rs.pending.Set(float64(sampleCount(tss)))
+
+		case <-ticker.C():
+			if dropped = droppedSamples.Swap(0); dropped > 0 {
+				log.Warningf("dropped %d timeseries in the last %ds as the queue was full", dropped, conf.Prometheus.FlushInterval)
+			}
+			log.Debugf("performing batched remote write for %d timeseries", len(tss)+len(window))
+			tss, window = batch(tss, window, buf, conf, clk.Now(), rs), nil
+			rs.pending.Set(float64(sampleCount(tss)))
+			if len(tss) == 0 {
+				buf.save(tss)
+				continue
+			}
+			tss = append(tss, flushIntervalSeries(clk.Now(), int(conf.Prometheus.FlushInterval)))
+			rs.pending.Inc()
+			buf.save(tss)
+			if unsent, err = storeChunks(w, tss, conf.Prometheus.MaxSamplesPerSend, retries, rs); err != nil {
+				if sent := len(tss) - len(unsent); sent > 0 {
+					log.Infof("pushed %d timeseries before failing", sent)
+				}
+				tss = unsent
+				buf.save(tss)
+				if errors.Is(err, errMarshal) {
+					// retrying would not help, this indicates a bug
+					log.Errorf("dropping %d timeseries: %s", len(tss), err)
+					rs.failed.Add(float64(sampleCount(tss)))
+					rs.pending.Set(0)
+					tss = []prompb.TimeSeries{}
+					buf.save(tss)
+					continue
+				}
+				if isRecoverable(err) {
+					log.Warningf("recoverable error pushing %d timeseries, retaining for next flush: %s", len(tss), err)
+					// bound what is retained by the queue capacity, dropping
+					// the oldest time-series first
+					if over := len(tss) - conf.Prometheus.QueueCapacity; over > 0 {
+						log.Warningf("dropping %d oldest retained timeseries as the queue is full", over)
+						droppedTotal.Add(float64(over))
+						rs.dropped.Add(float64(sampleCount(tss[:over])))
+						rs.pending.Sub(float64(sampleCount(tss[:over])))
+						tss = append([]prompb.TimeSeries{}, tss[over:]...)
+						buf.save(tss)
+					}
+					continue
+				}
+				failures++
+				log.Errorf("error pushing timeseries, dropping %d timeseries: %s", len(tss), err)
+				rs.failed.Add(float64(sampleCount(tss)))
+				rs.pending.Set(0)
+				tss = []prompb.TimeSeries{}
+				buf.save(tss)
+				if failures >= maxStoreFailures {
+					log.Errorf("%d consecutive irrecoverable errors pushing timeseries, stopping", failures)
+					Stop(stop)
+				}
+				continue
+			}
+			failures = 0
+			log.Infof("pushed %d timeseries", len(tss))
+			tss = []prompb.TimeSeries{}
+			buf.save(tss)
+		}
+	}
+
+}
+
+// batch returns the time-series to push, tss retained from earlier flushes
+// followed by window, the time-series received since the last flush,
+// aggregated on their own so that each flush keeps its own sample per series.
+// Expired time-series are dropped from both.
+func batch(tss, window []prompb.TimeSeries, buf *diskBuffer, conf Config, now time.Time, rs *remoteStorage) []prompb.TimeSeries {
+	tss = expire(tss, buf, conf.Prometheus.MaxSampleAge, now, rs)
+	// window has not been buffered yet
+	window = expire(window, nil, conf.Prometheus.MaxSampleAge, now, rs)
+	return append(tss, aggregate(window, conf.Prometheus.Aggregation)...)
+}
+
+// store pushes tss using w, retrying recoverable errors with exponential
+// backoff and recording each attempt in rs.
+func store(w Writer, tss []prompb.TimeSeries, p retryPolicy, rs *remoteStorage) (err error) {
+	start := p.clk.Now()
+	defer func() {
+		writeDuration.Observe(p.clk.Now().Sub(start).Seconds())
+		writeBatchSize.Observe(float64(len(tss)))
+		writesTotal.WithLabelValues(result(err)).Inc()
+	}()
+
+	n := float64(sampleCount(tss))
+	backoff := p.initial
+	for attempt := 1; ; attempt++ {
+		begin := p.clk.Now()
+		err = write(w, tss, p.timeout())
+		rs.duration.Observe(p.clk.Now().Sub(begin).Seconds())
+		rs.samples.Add(n)
+		if err == nil {
+			rs.markSent(tss)
+			return nil
+		}
+		if !isRecoverable(err) {
+			return err
+		}
+		rs.retried.Add(n)
+		if attempt > p.retries {
+			return err
+		}
+		delay := jittered(backoff, storeJitter)
+		if !p.deadline.IsZero() && p.clk.Now().Add(delay).After(p.deadline) {
+			return err
+		}
+		log.Infof("recoverable error pushing timeseries, retry %d of %d in %s: %s", attempt, p.retries, delay, err)
+		p.clk.Sleep(delay)
+		if backoff *= 2; backoff > p.max {
+			backoff = p.max
+		}
+	}
+}
+
+// storeChunks pushes tss in requests of at most maxSamples samples, returning
+// the time-series from the first failed request onwards.
+func storeChunks(w Writer, tss []prompb.TimeSeries, maxSamples int, p retryPolicy, rs *remoteStorage) ([]prompb.TimeSeries, error) {
+	for len(tss) > 0 {
+		n, samples := 0, 0
+		for n < len(tss) && (n == 0 || samples+len(tss[n].Samples) <= maxSamples) {
+			samples += len(tss[n].Samples)
+			n++
+		}
+		if err := store(w, tss[:n], p, rs); err != nil {
+			return tss, err
+		}
+		tss = tss[n:]
+	}
+	return nil, nil
+}
+
+// expire drops the samples in tss older than the retention of buf or than
+// maxAge seconds before now, counting them in tapmon_expired_samples_total
+// and as dropped by the output in rs.
+func expire(tss []prompb.TimeSeries, buf *diskBuffer, maxAge int, now time.Time, rs *remoteStorage) []prompb.TimeSeries {
+	tss, n := buf.expire(tss, now)
+	tss, m := expireOld(tss, maxAge, now)
+	expiredTotal.Add(float64(n + m))
+	rs.dropped.Add(float64(n + m))
+	return tss
+}
+
+// expireOld drops samples in tss more than maxAge seconds older than now,
+// logging and returning the number dropped. A maxAge of 0 keeps every
+// sample.
+func expireOld(tss []prompb.TimeSeries, maxAge int, now time.Time) ([]prompb.TimeSeries, int) {
+	if maxAge <= 0 {
+		return tss, 0
+	}
+	age := time.Duration(maxAge) * time.Second
+	tss, n := expireSamples(tss, now.Add(-age).UnixMilli())
+	if n > 0 {
+		log.Warningf("expired %d samples older than %s before flushing", n, age)
+	}
+	return tss, n
+}
+
+// flushIntervalSeries returns flush_interval_seconds at t, sent with each
+// flush.
+func flushIntervalSeries(t time.Time, interval int) prompb.TimeSeries {
+	return prompb.TimeSeries{
+		Labels:  seriesLabels(flushIntervalMetric.fullName()),
+		Samples: []prompb.Sample{{Timestamp: t.UnixMilli(), Value: float64(interval)}},
+	}
+}
+
+// sampleCount returns the number of samples in tss.
+func sampleCount(tss []prompb.TimeSeries) int {
+	var n int
+	for _, ts := range tss {
+		n += len(ts.Samples)
+	}
+	return n
+}
+
+// timeout returns the time allowed for an attempt, writeTimeout or less when
+// the deadline is sooner.
+func (p retryPolicy) timeout() time.Duration {
+	if p.deadline.IsZero() {
+		return writeTimeout
+	}
+	if d := p.deadline.Sub(p.clk.Now()); d < writeTimeout {
+		return d
+	}
+	return writeTimeout
+}
+
+// newRetryPolicy returns the store retry policy configured in conf, timed by
+// clk.
+func newRetryPolicy(conf Config, clk clock) retryPolicy {
+	return retryPolicy{
+		clk:     clk,
+		retries: conf.Prometheus.MaxRetries,
+		initial: time.Duration(conf.Prometheus.BackoffInitial) * time.Second,
+		max:     time.Duration(conf.Prometheus.BackoffMax) * time.Second,
+	}
+}
+
+// write makes a single attempt to push tss using w within timeout. A write
+// that times out is recoverable, the batch is retained for retry.
+func write(w Writer, tss []prompb.TimeSeries, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	select {
+	case writeSlots <- struct{}{}:
+	case <-ctx.Done():
+		return recoverableError{fmt.Errorf("timed out waiting for a write slot: %w", ctx.Err())}
+	}
+	writesInFlight.Inc()
+	err := w.Write(ctx, tss)
+	writesInFlight.Dec()
+	<-writeSlots
+	if err != nil && !isRecoverable(err) && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return recoverableError{err}
+	}
+	return err
+}
+
+func (t userAgentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("User-Agent", t.agent)
+	return t.next.RoundTrip(r)
+}
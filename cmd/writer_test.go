@@ -0,0 +1,358 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	// fakeWriter is a Writer recording each batch, failing with the queued
+	// errors before succeeding.
+	fakeWriter struct {
+		mu     sync.Mutex
+		errs   []error
+		writes [][]prompb.TimeSeries
+	}
+)
+
+func (w *fakeWriter) Write(_ context.Context, tss []prompb.TimeSeries) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, append([]prompb.TimeSeries(nil), tss...))
+	if len(w.errs) > 0 {
+		err := w.errs[0]
+		w.errs = w.errs[1:]
+		return err
+	}
+	return nil
+}
+
+// written returns the batches written so far.
+func (w *fakeWriter) written() [][]prompb.TimeSeries {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([][]prompb.TimeSeries(nil), w.writes...)
+}
+
+// testStorage returns remoteStorage metrics for tests.
+func testStorage() *remoteStorage {
+	return newRemoteStorage(Config{Output: "test"})
+}
+
+// seriesAt returns a time-series of metric name with a sample of 1 at t.
+func seriesAt(name string, t time.Time) prompb.TimeSeries {
+	return prompb.TimeSeries{
+		Labels:  seriesLabels(name),
+		Samples: []prompb.Sample{{Timestamp: t.UnixMilli(), Value: 1}},
+	}
+}
+
+func TestStoreBackoff(t *testing.T) {
+	unavailable := recoverableError{errors.New("503")}
+	for _, tc := range []struct {
+		name     string
+		errs     []error
+		retries  int
+		deadline time.Duration
+		wantErr  bool
+		// sleeps are the expected retry delays before jitter
+		sleeps []time.Duration
+	}{
+		{
+			name:    "retried until written",
+			errs:    []error{unavailable, unavailable, unavailable},
+			retries: 3,
+			sleeps:  []time.Duration{time.Second, 2 * time.Second, 2 * time.Second},
+		},
+		{
+			name:    "retries exhausted",
+			errs:    []error{unavailable, unavailable, unavailable},
+			retries: 1,
+			wantErr: true,
+			sleeps:  []time.Duration{time.Second},
+		},
+		{
+			name:     "deadline reached",
+			errs:     []error{unavailable, unavailable, unavailable},
+			retries:  3,
+			deadline: 1500 * time.Millisecond,
+			wantErr:  true,
+			sleeps:   []time.Duration{time.Second},
+		},
+		{
+			name:    "irrecoverable",
+			errs:    []error{errors.New("400")},
+			retries: 3,
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clk := newFakeClock(time.Unix(1669888800, 0))
+			w := &fakeWriter{errs: tc.errs}
+			p := retryPolicy{clk: clk, retries: tc.retries, initial: time.Second, max: 2 * time.Second}
+			if tc.deadline > 0 {
+				p.deadline = clk.Now().Add(tc.deadline)
+			}
+
+			err := store(w, []prompb.TimeSeries{seriesAt("a", clk.Now())}, p, testStorage())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tc.wantErr)
+			}
+			sleeps := clk.sleeps()
+			if len(sleeps) != len(tc.sleeps) {
+				t.Fatalf("got sleeps %v, want %v", sleeps, tc.sleeps)
+			}
+			for i, d := range tc.sleeps {
+				lo, hi := time.Duration(float64(d)*(1-storeJitter)), time.Duration(float64(d)*(1+storeJitter))
+				if sleeps[i] < lo || sleeps[i] > hi {
+					t.Errorf("got sleep %d of %s, want between %s and %s", i, sleeps[i], lo, hi)
+				}
+			}
+			if got, want := len(w.written()), len(sleeps)+1; got != want {
+				t.Errorf("got %d attempts, want %d", got, want)
+			}
+		})
+	}
+}
+
+// testWriteConfig returns a config for driving writeMetrics.
+func testWriteConfig() Config {
+	var conf Config
+	conf.Output = "test"
+	conf.ShutdownTimeout = 5
+	conf.Prometheus.FlushInterval = 10
+	conf.Prometheus.MaxSamplesPerSend = 100
+	conf.Prometheus.QueueCapacity = 100
+	return conf
+}
+
+// startWriteMetrics runs writeMetrics writing to w, returning once its flush
+// ticker is running. Closing stop and waiting on wg stops it.
+func startWriteMetrics(t *testing.T, clk *fakeClock, conf Config, w Writer) (chan prompb.TimeSeries, chan bool, *sync.WaitGroup) {
+	t.Helper()
+	var wg sync.WaitGroup
+
+	metrics := make(chan prompb.TimeSeries, conf.Prometheus.QueueCapacity)
+	stop := make(chan bool)
+	wg.Add(1)
+	go writeMetrics(&wg, stop, clk, metrics, nil, conf, func(Config) (Writer, error) {
+		return w, nil
+	})
+	waitFor(t, "the flush ticker", func() bool { return !clk.nextTick().IsZero() })
+	return metrics, stop, &wg
+}
+
+// send queues tss on metrics, waiting for writeMetrics to receive them.
+func send(t *testing.T, metrics chan prompb.TimeSeries, tss ...prompb.TimeSeries) {
+	t.Helper()
+	for _, ts := range tss {
+		metrics <- ts
+	}
+	waitFor(t, "time-series to be received", func() bool { return len(metrics) == 0 })
+}
+
+func TestWriteMetricsExpiry(t *testing.T) {
+	clk := newFakeClock(time.Unix(1669888800, 0))
+	w := &fakeWriter{}
+	conf := testWriteConfig()
+	conf.Prometheus.MaxSampleAge = 60
+	rs := testStorage()
+	dropped, expired := testutil.ToFloat64(rs.dropped), testutil.ToFloat64(expiredTotal)
+
+	metrics, stop, wg := startWriteMetrics(t, clk, conf, w)
+	now := clk.Now()
+	send(t, metrics, seriesAt("old", now.Add(-2*time.Minute)), seriesAt("new", now), seriesAt("new", now.Add(-30*time.Second)))
+	clk.Advance(10 * time.Second)
+	waitFor(t, "a flush", func() bool { return len(w.written()) == 1 })
+	close(stop)
+	wg.Wait()
+
+	flushed := clk.Now().UnixMilli()
+	want := []string{
+		"flush_interval_seconds{} 10@" + strconv.FormatInt(flushed, 10),
+		"new{} 1@" + strconv.FormatInt(now.Add(-30*time.Second).UnixMilli(), 10),
+		"new{} 1@" + strconv.FormatInt(now.UnixMilli(), 10),
+	}
+	if got := seriesStrings(w.written()[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("got series\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := testutil.ToFloat64(rs.dropped) - dropped; got != 1 {
+		t.Errorf("got %g samples counted as dropped, want 1", got)
+	}
+	if got := testutil.ToFloat64(expiredTotal) - expired; got != 1 {
+		t.Errorf("got %g samples counted as expired, want 1", got)
+	}
+}
+
+func TestExpireSamples(t *testing.T) {
+	tss := []prompb.TimeSeries{
+		{Labels: seriesLabels("a"), Samples: []prompb.Sample{{Timestamp: 1}, {Timestamp: 5}, {Timestamp: 10}}},
+		{Labels: seriesLabels("b"), Samples: []prompb.Sample{{Timestamp: 2}}},
+	}
+	before := seriesStrings(tss)
+
+	kept, n := expireSamples(tss, 5)
+	if want := []string{"a{} 0@10", "a{} 0@5"}; !reflect.DeepEqual(seriesStrings(kept), want) {
+		t.Errorf("got kept %v, want %v", seriesStrings(kept), want)
+	}
+	if n != 2 {
+		t.Errorf("got %d samples dropped, want 2", n)
+	}
+	if after := seriesStrings(tss); !reflect.DeepEqual(after, before) {
+		t.Errorf("expireSamples changed its argument to %v", after)
+	}
+}
+
+func TestStoreChunks(t *testing.T) {
+	now := time.Unix(1669888800, 0)
+	tss := []prompb.TimeSeries{seriesAt("a", now), seriesAt("b", now), seriesAt("c", now)}
+	tss = append(tss, prompb.TimeSeries{Labels: seriesLabels("d"), Samples: []prompb.Sample{{Timestamp: 1}, {Timestamp: 2}, {Timestamp: 3}}})
+	p := retryPolicy{clk: newFakeClock(now)}
+
+	w := &fakeWriter{}
+	if unsent, err := storeChunks(w, tss, 2, p, testStorage()); err != nil || unsent != nil {
+		t.Fatalf("got unsent %v and error %v", unsent, err)
+	}
+	var sizes []int
+	for _, batch := range w.written() {
+		sizes = append(sizes, sampleCount(batch))
+	}
+	// a series is never split, even when it exceeds maxSamples
+	if want := []int{2, 1, 3}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("got batches of %v samples, want %v", sizes, want)
+	}
+
+	w = &fakeWriter{errs: []error{nil, errors.New("400")}}
+	unsent, err := storeChunks(w, tss, 2, p, testStorage())
+	if err == nil {
+		t.Fatal("got no error from a failed batch")
+	}
+	if got, want := seriesStrings(unsent), seriesStrings(tss[2:]); !reflect.DeepEqual(got, want) {
+		t.Errorf("got unsent %v, want %v", got, want)
+	}
+}
+
+func TestWriteMetricsRetainsOnRecoverableError(t *testing.T) {
+	clk := newFakeClock(time.Unix(1669888800, 0))
+	w := &fakeWriter{errs: []error{recoverableError{errors.New("503")}}}
+	rs := testStorage()
+	retried := testutil.ToFloat64(rs.retried)
+
+	metrics, stop, wg := startWriteMetrics(t, clk, testWriteConfig(), w)
+	send(t, metrics, seriesAt("a", clk.Now()))
+	clk.Advance(10 * time.Second)
+	waitFor(t, "the failed flush", func() bool { return len(w.written()) == 1 })
+	send(t, metrics, seriesAt("b", clk.Now()))
+	clk.Advance(10 * time.Second)
+	waitFor(t, "the next flush", func() bool { return len(w.written()) == 2 })
+	close(stop)
+	wg.Wait()
+
+	var names []string
+	for _, ts := range w.written()[1] {
+		names = append(names, labelValue(ts.Labels, "__name__"))
+	}
+	// the failed batch, with its flush_interval_seconds, is sent again
+	if want := []string{"a", "flush_interval_seconds", "b", "flush_interval_seconds"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got series %v, want %v", names, want)
+	}
+	if got := testutil.ToFloat64(rs.retried) - retried; got != 2 {
+		t.Errorf("got %g samples retried, want 2", got)
+	}
+}
+
+func TestWriteMetricsDropsOnIrrecoverableError(t *testing.T) {
+	clk := newFakeClock(time.Unix(1669888800, 0))
+	w := &fakeWriter{errs: []error{errors.New("400")}}
+	rs := testStorage()
+	failed := testutil.ToFloat64(rs.failed)
+
+	metrics, stop, wg := startWriteMetrics(t, clk, testWriteConfig(), w)
+	send(t, metrics, seriesAt("a", clk.Now()))
+	clk.Advance(10 * time.Second)
+	waitFor(t, "the failed flush", func() bool { return len(w.written()) == 1 })
+	send(t, metrics, seriesAt("b", clk.Now()))
+	clk.Advance(10 * time.Second)
+	waitFor(t, "the next flush", func() bool { return len(w.written()) == 2 })
+	close(stop)
+	wg.Wait()
+
+	var names []string
+	for _, ts := range w.written()[1] {
+		names = append(names, labelValue(ts.Labels, "__name__"))
+	}
+	if want := []string{"b", "flush_interval_seconds"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got series %v, want %v", names, want)
+	}
+	if got := testutil.ToFloat64(rs.failed) - failed; got != 2 {
+		t.Errorf("got %g samples failed, want 2", got)
+	}
+}
+
+func TestWriteMetricsFlushesOnStop(t *testing.T) {
+	clk := newFakeClock(time.Unix(1669888800, 0))
+	w := &fakeWriter{}
+
+	metrics, stop, wg := startWriteMetrics(t, clk, testWriteConfig(), w)
+	send(t, metrics, seriesAt("a", clk.Now()))
+	// queued but not yet received when stopping
+	metrics <- seriesAt("b", clk.Now())
+	close(stop)
+	wg.Wait()
+
+	writes := w.written()
+	if len(writes) != 1 {
+		t.Fatalf("got %d writes, want 1", len(writes))
+	}
+	var names []string
+	for _, ts := range writes[0] {
+		names = append(names, labelValue(ts.Labels, "__name__"))
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got series %v, want %v", names, want)
+	}
+}
+
+func TestWriteMetricsAggregatesEachWindow(t *testing.T) {
+	clk := newFakeClock(time.Unix(1669888800, 0))
+	w := &fakeWriter{errs: []error{recoverableError{errors.New("503")}}}
+	conf := testWriteConfig()
+	conf.Prometheus.Aggregation = AggregationAvg
+	sample := func(v float64, at time.Time) prompb.TimeSeries {
+		return prompb.TimeSeries{Labels: seriesLabels("a"), Samples: []prompb.Sample{{Timestamp: at.UnixMilli(), Value: v}}}
+	}
+
+	metrics, stop, wg := startWriteMetrics(t, clk, conf, w)
+	start := clk.Now()
+	send(t, metrics, sample(1, start), sample(3, start.Add(5*time.Second)))
+	clk.Advance(10 * time.Second)
+	waitFor(t, "the failed flush", func() bool { return len(w.written()) == 1 })
+	send(t, metrics, sample(5, start.Add(12*time.Second)), sample(7, start.Add(15*time.Second)))
+	clk.Advance(10 * time.Second)
+	waitFor(t, "the next flush", func() bool { return len(w.written()) == 2 })
+	close(stop)
+	wg.Wait()
+
+	var got []string
+	for _, s := range seriesStrings(w.written()[1]) {
+		if strings.HasPrefix(s, "a{}") {
+			got = append(got, s)
+		}
+	}
+	// the window of the failed flush keeps its own average
+	want := []string{
+		"a{} 2@" + strconv.FormatInt(start.Add(5*time.Second).UnixMilli(), 10),
+		"a{} 6@" + strconv.FormatInt(start.Add(15*time.Second).UnixMilli(), 10),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got series %v, want %v", got, want)
+	}
+}